@@ -0,0 +1,101 @@
+package taipei
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Allocation selects how OpenFileStore reserves disk space for new files.
+type Allocation int
+
+const (
+	// AllocateSparse extends files with truncate, leaving holes that are
+	// filled in as data arrives. This is fast but may fragment badly.
+	AllocateSparse Allocation = iota
+	// AllocateFull reserves every block up front. It uses fallocate where
+	// the platform and filesystem support it and falls back to zero-fill.
+	AllocateFull
+	// AllocateZero writes zeros over the whole file.
+	AllocateZero
+)
+
+func (a Allocation) String() string {
+	switch a {
+	case AllocateSparse:
+		return "sparse"
+	case AllocateFull:
+		return "full"
+	case AllocateZero:
+		return "zero"
+	}
+	return fmt.Sprintf("Allocation(%d)", int(a))
+}
+
+// SpaceError is returned by OpenFileStore when the files do not fit in the
+// free space of the target filesystem.
+type SpaceError struct {
+	Path string
+	Need int64
+	Free int64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("Not enough disk space in %s: need %d bytes, %d available.", e.Path, e.Need, e.Free)
+}
+
+const zeroFillChunk = 1 << 20
+
+// zeroFill writes zeros to fd from off up to end.
+func zeroFill(fd *os.File, off, end int64) (err error) {
+	zeros := make([]byte, zeroFillChunk)
+	for off < end {
+		chunk := int64(len(zeros))
+		if end-off < chunk {
+			chunk = end - off
+		}
+		var n int
+		n, err = fd.WriteAt(zeros[:chunk], off)
+		if err != nil {
+			return
+		}
+		off += int64(n)
+	}
+	return
+}
+
+// checkSpace makes sure files fit in the filesystem holding dir. Space
+// already taken by existing files is taken into account.
+func checkSpace(dir string, files []fileEntry) error {
+	var need int64
+	for i, _ := range files {
+		need += files[i].length
+		if st, err := os.Stat(files[i].name); err == nil && st.Size() <= files[i].length {
+			need -= st.Size()
+		}
+	}
+	if need <= 0 {
+		return nil
+	}
+	// The store directory may not exist yet, so ask for its nearest
+	// existing ancestor.
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if free >= 0 && need > free {
+		return &SpaceError{dir, need, free}
+	}
+	return nil
+}
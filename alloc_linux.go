@@ -0,0 +1,19 @@
+package taipei
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the blocks for [off, off+n) in fd, extending the file
+// as needed. Filesystems without fallocate support are zero-filled instead.
+func fallocate(fd *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), 0, off, n)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return zeroFill(fd, off, off+n)
+	}
+	if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package taipei
+
+import (
+	"os"
+)
+
+// fallocate has no portable equivalent, so the range is zero-filled.
+func fallocate(fd *os.File, off, n int64) error {
+	return zeroFill(fd, off, off+n)
+}
@@ -1,5 +1,10 @@
 package taipei
 
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
 // As defined by the bittorrent protocol, this bitset is big-endian, such that
 // the high bit of the first byte is block 0
 
@@ -22,10 +27,10 @@ func NewBitset(n int) *Bitset {
 // Creates a new bitset from a given byte stream. Returns nil if the
 // data is invalid in some way.
 func NewBitsetFromBytes(n int, data []byte) *Bitset {
-	bitset := NewBitset(n)
-	if len(bitset.b) != len(data) {
+	if n < 0 || (n+7)>>3 != len(data) {
 		return nil
 	}
+	bitset := NewBitset(n)
 	copy(bitset.b, data)
 	if bitset.endIndex >= 0 && bitset.b[bitset.endIndex]&(^bitset.endMask) != 0 {
 		return nil
@@ -33,6 +38,11 @@ func NewBitsetFromBytes(n int, data []byte) *Bitset {
 	return bitset
 }
 
+// Len returns the number of bits in the set.
+func (b *Bitset) Len() int {
+	return b.n
+}
+
 func (b *Bitset) Set(index int) {
 	if index < 0 || index >= b.n {
 		panic("Index out of range.")
@@ -55,15 +65,74 @@ func (b *Bitset) IsSet(index int) bool {
 }
 
 func (b *Bitset) AndNot(b2 *Bitset) {
-	if b.n != b2.n {
-		panic("Unequal bitset sizes")
+	b.checkSize(b2)
+	i := 0
+	for ; i+8 <= len(b.b); i += 8 {
+		w := binary.LittleEndian.Uint64(b.b[i:]) &^ binary.LittleEndian.Uint64(b2.b[i:])
+		binary.LittleEndian.PutUint64(b.b[i:], w)
 	}
-	for i := 0; i < len(b.b); i++ {
+	for ; i < len(b.b); i++ {
 		b.b[i] = b.b[i] & ^b2.b[i]
 	}
 	b.clearEnd()
 }
 
+func (b *Bitset) And(b2 *Bitset) {
+	b.checkSize(b2)
+	i := 0
+	for ; i+8 <= len(b.b); i += 8 {
+		w := binary.LittleEndian.Uint64(b.b[i:]) & binary.LittleEndian.Uint64(b2.b[i:])
+		binary.LittleEndian.PutUint64(b.b[i:], w)
+	}
+	for ; i < len(b.b); i++ {
+		b.b[i] &= b2.b[i]
+	}
+}
+
+func (b *Bitset) Or(b2 *Bitset) {
+	b.checkSize(b2)
+	i := 0
+	for ; i+8 <= len(b.b); i += 8 {
+		w := binary.LittleEndian.Uint64(b.b[i:]) | binary.LittleEndian.Uint64(b2.b[i:])
+		binary.LittleEndian.PutUint64(b.b[i:], w)
+	}
+	for ; i < len(b.b); i++ {
+		b.b[i] |= b2.b[i]
+	}
+	b.clearEnd()
+}
+
+func (b *Bitset) Xor(b2 *Bitset) {
+	b.checkSize(b2)
+	i := 0
+	for ; i+8 <= len(b.b); i += 8 {
+		w := binary.LittleEndian.Uint64(b.b[i:]) ^ binary.LittleEndian.Uint64(b2.b[i:])
+		binary.LittleEndian.PutUint64(b.b[i:], w)
+	}
+	for ; i < len(b.b); i++ {
+		b.b[i] ^= b2.b[i]
+	}
+	b.clearEnd()
+}
+
+// Not flips every bit.
+func (b *Bitset) Not() {
+	i := 0
+	for ; i+8 <= len(b.b); i += 8 {
+		binary.LittleEndian.PutUint64(b.b[i:], ^binary.LittleEndian.Uint64(b.b[i:]))
+	}
+	for ; i < len(b.b); i++ {
+		b.b[i] = ^b.b[i]
+	}
+	b.clearEnd()
+}
+
+func (b *Bitset) checkSize(b2 *Bitset) {
+	if b.n != b2.n {
+		panic("Unequal bitset sizes")
+	}
+}
+
 func (b *Bitset) clearEnd() {
 	if b.endIndex >= 0 {
 		b.b[b.endIndex] &= b.endMask
@@ -77,26 +146,108 @@ func (b *Bitset) IsEndValid() bool {
 	return true
 }
 
-// TODO: Make this fast
-func (b *Bitset) FindNextSet(index int) int {
-	for i := index; i < b.n; i++ {
-		if (b.b[i>>3] & byte(128>>byte(i&7))) != 0 {
-			return i
+// Equal reports whether both bitsets have the same size and bits.
+func (b *Bitset) Equal(b2 *Bitset) bool {
+	if b.n != b2.n {
+		return false
+	}
+	for i := range b.b {
+		if b.b[i] != b2.b[i] {
+			return false
 		}
 	}
-	return -1
+	return true
+}
+
+func (b *Bitset) Clone() *Bitset {
+	c := *b
+	c.b = make([]byte, len(b.b))
+	copy(c.b, b.b)
+	return &c
+}
+
+// Count returns the number of set bits.
+func (b *Bitset) Count() int {
+	count := 0
+	i := 0
+	for ; i+8 <= len(b.b); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(b.b[i:]))
+	}
+	for ; i < len(b.b); i++ {
+		count += bits.OnesCount8(b.b[i])
+	}
+	return count
+}
+
+// All reports whether every bit is set.
+func (b *Bitset) All() bool {
+	return b.FindNextClear(0) < 0
 }
 
-// TODO: Make this fast
+// None reports whether no bit is set.
+func (b *Bitset) None() bool {
+	return b.FindNextSet(0) < 0
+}
+
+// ForEach calls f with the index of every set bit in increasing order,
+// stopping early if f returns false.
+func (b *Bitset) ForEach(f func(index int) bool) {
+	for i := b.FindNextSet(0); i >= 0; i = b.FindNextSet(i + 1) {
+		if !f(i) {
+			return
+		}
+	}
+}
+
+// FindNextSet returns the index of the first set bit at or after index, or
+// -1 if there is none.
+func (b *Bitset) FindNextSet(index int) int {
+	return b.findNext(index, 0)
+}
+
+// FindNextClear returns the index of the first clear bit at or after index,
+// or -1 if there is none.
 func (b *Bitset) FindNextClear(index int) int {
-	for i := index; i < b.n; i++ {
-		if (b.b[i>>3] & byte(128>>byte(i&7))) == 0 {
-			return i
+	return b.findNext(index, 0xff)
+}
+
+// findNext scans for the first bit at or after index that is set once the
+// bytes are XORed with flip, a word at a time.
+func (b *Bitset) findNext(index int, flip byte) int {
+	if index < 0 {
+		index = 0
+	}
+	if index >= b.n {
+		return -1
+	}
+	i := index >> 3
+	// Mask off the bits before index in the first byte.
+	if c := (b.b[i] ^ flip) & (255 >> byte(index&7)); c != 0 {
+		return b.found(i<<3 + bits.LeadingZeros8(c))
+	}
+	flip64 := uint64(flip) * 0x0101010101010101
+	for i++; i+8 <= len(b.b); i += 8 {
+		// Big-endian keeps bit 0 of the word as the most significant.
+		if w := binary.BigEndian.Uint64(b.b[i:]) ^ flip64; w != 0 {
+			return b.found(i<<3 + bits.LeadingZeros64(w))
+		}
+	}
+	for ; i < len(b.b); i++ {
+		if c := b.b[i] ^ flip; c != 0 {
+			return b.found(i<<3 + bits.LeadingZeros8(c))
 		}
 	}
 	return -1
 }
 
+// found discards hits in the padding bits of the last byte.
+func (b *Bitset) found(index int) int {
+	if index >= b.n {
+		return -1
+	}
+	return index
+}
+
 func (b *Bitset) Bytes() []byte {
 	return b.b
 }
@@ -0,0 +1,171 @@
+package taipei
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxParsedBitsetLen caps the number of bits of a bitset decoded from text,
+// hex or JSON, whose length may come from an untrusted source.
+const MaxParsedBitsetLen = 1 << 24
+
+func checkParsedLen(n int) error {
+	if n < 0 || n > MaxParsedBitsetLen {
+		return fmt.Errorf("Bitset length %d out of range.", n)
+	}
+	return nil
+}
+
+// Range is a run of consecutive bits, from First to Last inclusive.
+type Range struct {
+	First, Last int
+}
+
+func (r Range) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(r.First)
+	}
+	return strconv.Itoa(r.First) + "-" + strconv.Itoa(r.Last)
+}
+
+// SetRanges returns the runs of set bits in increasing order.
+func (b *Bitset) SetRanges() []Range {
+	return b.ranges(b.FindNextSet, b.FindNextClear)
+}
+
+// ClearRanges returns the runs of clear bits in increasing order.
+func (b *Bitset) ClearRanges() []Range {
+	return b.ranges(b.FindNextClear, b.FindNextSet)
+}
+
+func (b *Bitset) ranges(start, stop func(int) int) (r []Range) {
+	for i := start(0); i >= 0; {
+		end := stop(i)
+		if end < 0 {
+			end = b.n
+		}
+		r = append(r, Range{i, end - 1})
+		i = start(end)
+	}
+	return
+}
+
+// String returns the set bits in the compact range form, such as
+// "0-1023,2048-4095".
+func (b *Bitset) String() string {
+	var buf bytes.Buffer
+	for i, r := range b.SetRanges() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(r.String())
+	}
+	return buf.String()
+}
+
+// ParseBitsetRanges creates a bitset of n bits from the range form produced
+// by String. n may be at most MaxParsedBitsetLen.
+func ParseBitsetRanges(n int, s string) (*Bitset, error) {
+	if err := checkParsedLen(n); err != nil {
+		return nil, err
+	}
+	b := NewBitset(n)
+	if s == "" {
+		return b, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		first, last := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		f, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("Bad bitset range %q.", part)
+		}
+		l, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("Bad bitset range %q.", part)
+		}
+		if f < 0 || l < f || l >= n {
+			return nil, fmt.Errorf("Bitset range %q out of bounds for %d bits.", part, n)
+		}
+		for i := f; i <= l; i++ {
+			b.Set(i)
+		}
+	}
+	return b, nil
+}
+
+// Hex returns the bytes of the bitset in hexadecimal.
+func (b *Bitset) Hex() string {
+	return hex.EncodeToString(b.b)
+}
+
+// ParseBitsetHex creates a bitset of n bits from the form produced by Hex.
+// n may be at most MaxParsedBitsetLen.
+func ParseBitsetHex(n int, s string) (*Bitset, error) {
+	if err := checkParsedLen(n); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBitsetFromBytes(n, data)
+	if b == nil {
+		return nil, fmt.Errorf("Invalid bitset data for %d bits.", n)
+	}
+	return b, nil
+}
+
+// MarshalBinary encodes the bitset as its length in bits, as a uvarint,
+// followed by its bytes.
+func (b *Bitset) MarshalBinary() ([]byte, error) {
+	data := make([]byte, binary.MaxVarintLen64+len(b.b))
+	i := binary.PutUvarint(data, uint64(b.n))
+	i += copy(data[i:], b.b)
+	return data[:i], nil
+}
+
+func (b *Bitset) UnmarshalBinary(data []byte) error {
+	n, i := binary.Uvarint(data)
+	if i <= 0 || n > uint64(len(data))*8 {
+		return errors.New("Invalid bitset length.")
+	}
+	c := NewBitsetFromBytes(int(n), data[i:])
+	if c == nil {
+		return errors.New("Invalid bitset data.")
+	}
+	*b = *c
+	return nil
+}
+
+// MarshalText encodes the bitset as its length in bits, a colon and the
+// range form, such as "4096:0-1023,2048-4095". The text form is also used
+// for JSON.
+func (b *Bitset) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(b.n) + ":" + b.String()), nil
+}
+
+func (b *Bitset) UnmarshalText(text []byte) error {
+	s := string(text)
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return errors.New("Bitset text is missing its length.")
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || checkParsedLen(n) != nil {
+		return fmt.Errorf("Bad bitset length %q.", s[:i])
+	}
+	c, err := ParseBitsetRanges(n, s[i+1:])
+	if err != nil {
+		return err
+	}
+	*b = *c
+	return nil
+}
@@ -0,0 +1,223 @@
+package taipei
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func randomBitset(r *rand.Rand, n int, density float64) *Bitset {
+	b := NewBitset(n)
+	for i := 0; i < n; i++ {
+		if r.Float64() < density {
+			b.Set(i)
+		}
+	}
+	return b
+}
+
+func TestBitsetFind(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 7, 8, 9, 63, 64, 65, 200, 1031} {
+		for _, density := range []float64{0, 0.01, 0.5, 0.99, 1} {
+			b := randomBitset(r, n, density)
+			for i := -1; i <= n; i++ {
+				wantSet, wantClear := -1, -1
+				for j := i; j < n; j++ {
+					if j < 0 {
+						continue
+					}
+					if wantSet < 0 && b.IsSet(j) {
+						wantSet = j
+					}
+					if wantClear < 0 && !b.IsSet(j) {
+						wantClear = j
+					}
+				}
+				if got := b.FindNextSet(i); got != wantSet {
+					t.Fatalf("n=%d FindNextSet(%d) = %d, wanted %d", n, i, got, wantSet)
+				}
+				if got := b.FindNextClear(i); got != wantClear {
+					t.Fatalf("n=%d FindNextClear(%d) = %d, wanted %d", n, i, got, wantClear)
+				}
+			}
+		}
+	}
+}
+
+func TestBitsetOps(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	n := 1001
+	a := randomBitset(r, n, 0.5)
+	b := randomBitset(r, n, 0.5)
+	and, or, xor, andNot, not := a.Clone(), a.Clone(), a.Clone(), a.Clone(), a.Clone()
+	and.And(b)
+	or.Or(b)
+	xor.Xor(b)
+	andNot.AndNot(b)
+	not.Not()
+	count := 0
+	for i := 0; i < n; i++ {
+		x, y := a.IsSet(i), b.IsSet(i)
+		if x {
+			count++
+		}
+		if and.IsSet(i) != (x && y) || or.IsSet(i) != (x || y) || xor.IsSet(i) != (x != y) ||
+			andNot.IsSet(i) != (x && !y) || not.IsSet(i) != !x {
+			t.Fatalf("Bit %d wrong", i)
+		}
+	}
+	if a.Count() != count {
+		t.Errorf("Count = %d, wanted %d", a.Count(), count)
+	}
+	if !not.IsEndValid() {
+		t.Error("Not set padding bits")
+	}
+	if !a.Equal(a.Clone()) || a.Equal(b) {
+		t.Error("Equal is wrong")
+	}
+	not.Or(a)
+	if !not.All() || not.None() || not.Count() != n {
+		t.Error("Wanted all bits set")
+	}
+	not.Xor(not.Clone())
+	if not.All() || !not.None() || not.Count() != 0 {
+		t.Error("Wanted no bits set")
+	}
+	var seen []int
+	a.ForEach(func(i int) bool {
+		seen = append(seen, i)
+		return true
+	})
+	if len(seen) != count {
+		t.Errorf("ForEach visited %d bits, wanted %d", len(seen), count)
+	}
+	for _, i := range seen {
+		if !a.IsSet(i) {
+			t.Errorf("ForEach visited clear bit %d", i)
+		}
+	}
+}
+
+const benchBits = 4 << 20
+
+func BenchmarkBitsetFindNextSet(b *testing.B) {
+	bs := NewBitset(benchBits)
+	bs.Set(benchBits - 1)
+	b.SetBytes(benchBits / 8)
+	for i := 0; i < b.N; i++ {
+		bs.FindNextSet(0)
+	}
+}
+
+func BenchmarkBitsetFindNextClear(b *testing.B) {
+	bs := NewBitset(benchBits)
+	bs.Not()
+	bs.Clear(benchBits - 1)
+	b.SetBytes(benchBits / 8)
+	for i := 0; i < b.N; i++ {
+		bs.FindNextClear(0)
+	}
+}
+
+func BenchmarkBitsetCount(b *testing.B) {
+	bs := randomBitset(rand.New(rand.NewSource(3)), benchBits, 0.5)
+	b.SetBytes(benchBits / 8)
+	for i := 0; i < b.N; i++ {
+		bs.Count()
+	}
+}
+
+func BenchmarkBitsetAnd(b *testing.B) {
+	r := rand.New(rand.NewSource(4))
+	x, y := randomBitset(r, benchBits, 0.5), randomBitset(r, benchBits, 0.5)
+	b.SetBytes(benchBits / 8)
+	for i := 0; i < b.N; i++ {
+		x.And(y)
+	}
+}
+
+func BenchmarkBitsetForEach(b *testing.B) {
+	bs := randomBitset(rand.New(rand.NewSource(5)), benchBits, 0.01)
+	b.SetBytes(benchBits / 8)
+	for i := 0; i < b.N; i++ {
+		bs.ForEach(func(int) bool { return true })
+	}
+}
+
+func TestBitsetRanges(t *testing.T) {
+	b := NewBitset(20)
+	for _, i := range []int{0, 1, 2, 5, 10, 11, 19} {
+		b.Set(i)
+	}
+	if s := b.String(); s != "0-2,5,10-11,19" {
+		t.Errorf("String = %q", s)
+	}
+	want := []Range{{3, 4}, {6, 9}, {12, 18}}
+	if r := b.ClearRanges(); !reflect.DeepEqual(r, want) {
+		t.Errorf("ClearRanges = %v, wanted %v", r, want)
+	}
+	c, err := ParseBitsetRanges(20, b.String())
+	if err != nil || !c.Equal(b) {
+		t.Errorf("ParseBitsetRanges = %v, %v", c, err)
+	}
+	for _, bad := range []string{"20", "3-1", "-1", "a", "1-b", "1,"} {
+		if _, err := ParseBitsetRanges(20, bad); err == nil {
+			t.Errorf("ParseBitsetRanges(%q) should fail", bad)
+		}
+	}
+	if c, err = ParseBitsetHex(20, b.Hex()); err != nil || !c.Equal(b) {
+		t.Errorf("ParseBitsetHex(%q) = %v, %v", b.Hex(), c, err)
+	}
+	if _, err = ParseBitsetHex(20, "ffffff"); err == nil {
+		t.Error("ParseBitsetHex should reject padding bits")
+	}
+}
+
+func TestBitsetMarshal(t *testing.T) {
+	b := randomBitset(rand.New(rand.NewSource(6)), 1234, 0.3)
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Bitset
+	if err = c.UnmarshalBinary(data); err != nil || !c.Equal(b) {
+		t.Errorf("Binary round trip failed: %v", err)
+	}
+	if err = c.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("UnmarshalBinary should reject short data")
+	}
+	js, err := json.Marshal(struct{ Have *Bitset }{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Have *Bitset }
+	if err = json.Unmarshal(js, &v); err != nil || !v.Have.Equal(b) {
+		t.Errorf("JSON round trip failed: %v", err)
+	}
+	text, _ := NewBitset(8).MarshalText()
+	if string(text) != "8:" {
+		t.Errorf("MarshalText = %q", text)
+	}
+	// Untrusted lengths are checked before anything is allocated.
+	for _, s := range []string{"9223372036854775807:", "1000000000000:", "-1:", "16777217:"} {
+		if err = c.UnmarshalText([]byte(s)); err == nil {
+			t.Errorf("UnmarshalText(%q) succeeded", s)
+		}
+	}
+	if err = json.Unmarshal([]byte(`{"Have":"9223372036854775807:"}`), &v); err == nil {
+		t.Error("json.Unmarshal accepted a huge bitset")
+	}
+	for _, n := range []int{-1, MaxParsedBitsetLen + 1, int(^uint(0) >> 1)} {
+		if _, err = ParseBitsetRanges(n, ""); err == nil {
+			t.Errorf("ParseBitsetRanges(%d) succeeded", n)
+		}
+		if _, err = ParseBitsetHex(n, ""); err == nil {
+			t.Errorf("ParseBitsetHex(%d) succeeded", n)
+		}
+		if NewBitsetFromBytes(n, nil) != nil {
+			t.Errorf("NewBitsetFromBytes(%d) succeeded", n)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func startNodes(t *testing.T, n int) []*Server {
+	var nodes []*Server
+	for i := 0; i < n; i++ {
+		s, err := Listen("127.0.0.1:0", &Config{QueryTimeout: 500 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		nodes = append(nodes, s)
+	}
+	ctx := context.Background()
+	for _, s := range nodes[1:] {
+		if err := s.Bootstrap(ctx, nodes[0].Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return nodes
+}
+
+func TestLookup(t *testing.T) {
+	nodes := startNodes(t, 24)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ih := RandomID()
+	if _, err := nodes[5].Announce(ctx, ih, 6881); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[9].Announce(ctx, ih, 0); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := nodes[17].GetPeers(ctx, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"127.0.0.1:6881": true, nodes[9].Addr().String(): true}
+	if len(peers) != 2 || !want[peers[0].String()] || !want[peers[1].String()] {
+		t.Errorf("Got peers %v, wanted %v", peers, want)
+	}
+	if peers, err = nodes[3].GetPeers(ctx, RandomID()); err != nil || len(peers) != 0 {
+		t.Errorf("Unknown torrent got %v, %v", peers, err)
+	}
+	if len(nodes[17].Nodes()) < K {
+		t.Errorf("Routing table has %d nodes", len(nodes[17].Nodes()))
+	}
+}
+
+func TestQueries(t *testing.T) {
+	nodes := startNodes(t, 2)
+	a, b := nodes[0], nodes[1]
+	ctx := context.Background()
+	id, err := a.Ping(ctx, b.Addr().String())
+	if err != nil || id != b.ID() {
+		t.Errorf("Ping got %v, %v", id, err)
+	}
+	ua := b.Addr().(*net.UDPAddr)
+	var ih ID
+	_, err = a.query(ctx, ua, "announce_peer", map[string]interface{}{"info_hash": string(ih[:]), "port": 1, "token": "forged"})
+	if e, ok := err.(*Error); !ok || e.Code != ErrProtocol {
+		t.Errorf("Forged token got %v", err)
+	}
+	if _, err = a.query(ctx, ua, "frobnicate", map[string]interface{}{}); err == nil || err.(*Error).Code != ErrMethodUnknown {
+		t.Errorf("Unknown method got %v", err)
+	}
+	b.Close()
+	if _, err = a.Ping(ctx, ua.String()); err != ErrTimeout {
+		t.Errorf("Closed node got %v", err)
+	}
+	if _, err = b.Ping(ctx, a.Addr().String()); err != ErrClosed {
+		t.Errorf("Query from closed node got %v", err)
+	}
+	lonely, _ := Listen("127.0.0.1:0", nil)
+	defer lonely.Close()
+	if _, err = lonely.GetPeers(ctx, ih); err != ErrNoNodes {
+		t.Errorf("Wanted ErrNoNodes, got %v", err)
+	}
+}
+
+func TestAnnounceLimit(t *testing.T) {
+	s := NewServer(newDiscardConn(), nil)
+	defer s.Close()
+	from := &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	token := s.token(from.IP, 0)
+	other := RandomID()
+	announce := func(ih ID) {
+		s.handleQuery(map[string]interface{}{"q": "announce_peer", "ro": int64(1), "a": map[string]interface{}{
+			"id": string(other[:]), "info_hash": string(ih[:]), "port": int64(1), "token": token,
+		}}, "aa", from)
+	}
+	// One token lets a node announce any number of hashes; only
+	// maxPeerHashes of them are kept.
+	for i := 0; i < maxPeerHashes+100; i++ {
+		announce(RandomID())
+	}
+	s.mu.Lock()
+	if len(s.peers) != maxPeerHashes {
+		t.Errorf("Stored %d info hashes, wanted %d", len(s.peers), maxPeerHashes)
+	}
+	// Expired announcements make room for new ones.
+	for _, peers := range s.peers {
+		for key := range peers {
+			peers[key] = time.Now().Add(-PeerTTL - time.Minute)
+		}
+	}
+	s.mu.Unlock()
+	ih := RandomID()
+	announce(ih)
+	s.mu.Lock()
+	if len(s.peers) != 1 || len(s.peers[ih]) != 1 {
+		t.Errorf("Stored %d info hashes after expiry", len(s.peers))
+	}
+	s.mu.Unlock()
+}
+
+func TestTable(t *testing.T) {
+	var self ID
+	tab := newTable(self)
+	now := time.Unix(1000, 0)
+	tab.now = func() time.Time { return now }
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	// Ids with the top bit set all share bucket 0.
+	var ids []ID
+	for i := 0; i < K+1; i++ {
+		var id ID
+		id[0], id[19] = 0x80, byte(i)
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:K] {
+		if ok, _ := tab.add(NodeInfo{id, addr}); !ok {
+			t.Fatal("Bucket rejected a node")
+		}
+	}
+	if ok, ping := tab.add(NodeInfo{ids[K], addr}); ok || ping != nil {
+		t.Error("Full bucket of good nodes accepted a node")
+	}
+	tab.failed(ids[3])
+	tab.failed(ids[3])
+	if ok, _ := tab.add(NodeInfo{ids[K], addr}); !ok {
+		t.Error("Bad node was not replaced")
+	}
+	// Questionable nodes are pinged, not evicted.
+	now = now.Add(questionableAfter)
+	var other ID
+	other[0], other[1] = 0x80, 1
+	ok, ping := tab.add(NodeInfo{other, addr})
+	if ok || ping == nil || ping.ID != ids[0] {
+		t.Fatalf("Got %v, %v; wanted a ping of the oldest node", ok, ping)
+	}
+	// A flood of new ids does not ping the same node twice.
+	var flood ID
+	flood[0], flood[1] = 0x80, 2
+	if _, ping = tab.add(NodeInfo{flood, addr}); ping == nil || ping.ID != ids[1] {
+		t.Errorf("Got ping %v, wanted the next oldest node", ping)
+	}
+	// A node answering the ping stays.
+	tab.add(NodeInfo{ids[1], addr})
+	tab.pinged(ids[1])
+	// A node failing it is replaced by the newest candidate.
+	tab.failed(ids[0])
+	tab.failed(ids[0])
+	tab.pinged(ids[0])
+	var in []ID
+	for _, n := range tab.nodes() {
+		in = append(in, n.ID)
+	}
+	if len(in) != K || in[K-1] != flood || in[0] != ids[2] {
+		t.Errorf("Got bucket %v", in)
+	}
+	tab.failed(ids[2])
+	tab.failed(ids[2])
+	if got := tab.nodes(); len(got) != K || got[K-1].ID != other {
+		t.Errorf("Older candidate was not used: %v", got)
+	}
+	if ok, _ := tab.add(NodeInfo{self, addr}); ok {
+		t.Error("Added our own id")
+	}
+	var target ID
+	target[0], target[19] = 0x80, 5
+	got := tab.closest(target, 3)
+	if len(got) != 3 || got[0].ID != ids[5] || got[1].ID != ids[4] || got[2].ID != ids[7] {
+		t.Errorf("Got closest %v", got)
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []NodeInfo{
+		{RandomID(), &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 6881}},
+		{RandomID(), &net.UDPAddr{IP: net.IP{192, 168, 1, 2}, Port: 443}},
+	}
+	got := decodeNodes(encodeNodes(nodes) + "junk")
+	if len(got) != 2 || got[0].String() != nodes[0].String() || got[1].String() != nodes[1].String() {
+		t.Errorf("Got %v, wanted %v", got, nodes)
+	}
+	if p := decodePeer(encodePeer(&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80})); p.String() != "1.2.3.4:80" {
+		t.Errorf("Got peer %v", p)
+	}
+}
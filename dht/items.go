@@ -0,0 +1,326 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Storage of arbitrary items (BEP 44). Values are bencodable Go values as
+// returned by bencode.Decode: strings, int64s, lists and dictionaries.
+// They are signed and hashed in their canonical encoding, with sorted
+// dictionary keys.
+
+const (
+	// MaxValueSize is the largest bencoded value that can be stored.
+	MaxValueSize = 1000
+	// MaxSaltSize is the largest salt of a mutable item.
+	MaxSaltSize = 64
+	// ItemTTL is how long items are kept without being put again.
+	ItemTTL = 2 * time.Hour
+
+	maxItems = 1000
+)
+
+// KRPC error codes of BEP 44.
+const (
+	ErrMessageTooBig    = 205
+	ErrInvalidSignature = 206
+	ErrSaltTooBig       = 207
+	ErrCASMismatch      = 301
+	ErrSeqTooLow        = 302
+)
+
+var ErrItemNotFound = errors.New("DHT item not found.")
+
+// encodeValue returns the canonical encoding of v, checking its size.
+func encodeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, v); err != nil {
+		return nil, err
+	}
+	if buf.Len() > MaxValueSize {
+		return nil, fmt.Errorf("Item value has %d bytes, more than %d.", buf.Len(), MaxValueSize)
+	}
+	return buf.Bytes(), nil
+}
+
+// ImmutableTarget returns the key an immutable item is stored under: the
+// SHA-1 of its bencoded value.
+func ImmutableTarget(v interface{}) (ID, error) {
+	b, err := encodeValue(v)
+	if err != nil {
+		return ID{}, err
+	}
+	return sha1.Sum(b), nil
+}
+
+// MutableTarget returns the key of the mutable items of a public key and
+// salt.
+func MutableTarget(k ed25519.PublicKey, salt string) ID {
+	return sha1.Sum(append(append([]byte(nil), k...), salt...))
+}
+
+// MutableItem is a value signed by the owner of K. Items with a higher Seq
+// replace those with a lower one.
+type MutableItem struct {
+	V    interface{}
+	K    ed25519.PublicKey
+	Salt string
+	Seq  int64
+	Sig  []byte
+}
+
+// NewMutableItem returns the item for v signed with key.
+func NewMutableItem(key ed25519.PrivateKey, v interface{}, salt string, seq int64) (*MutableItem, error) {
+	if len(salt) > MaxSaltSize {
+		return nil, errors.New("Item salt is too long.")
+	}
+	b, err := encodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return &MutableItem{
+		V:    v,
+		K:    key.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+		Sig:  ed25519.Sign(key, signedData(salt, seq, b)),
+	}, nil
+}
+
+func (m *MutableItem) Target() ID {
+	return MutableTarget(m.K, m.Salt)
+}
+
+// Verify checks the item's signature and sizes.
+func (m *MutableItem) Verify() error {
+	if len(m.Salt) > MaxSaltSize {
+		return errors.New("Item salt is too long.")
+	}
+	b, err := encodeValue(m.V)
+	if err != nil {
+		return err
+	}
+	if len(m.K) != ed25519.PublicKeySize || len(m.Sig) != ed25519.SignatureSize ||
+		!ed25519.Verify(m.K, signedData(m.Salt, m.Seq, b), m.Sig) {
+		return errors.New("Item signature is invalid.")
+	}
+	return nil
+}
+
+// signedData returns the bytes signed for a mutable item with the
+// bencoded value v.
+func signedData(salt string, seq int64, v []byte) []byte {
+	var buf bytes.Buffer
+	if salt != "" {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(v)
+	return buf.Bytes()
+}
+
+type storedItem struct {
+	v       interface{}
+	mutable *MutableItem // Nil for immutable items.
+	stored  time.Time
+}
+
+// handleGet answers a get query for a's target into r.
+func (s *Server) handleGet(a map[string]interface{}, from *net.UDPAddr, r map[string]interface{}) *Error {
+	target, ok := getID(a, "target")
+	if !ok {
+		return &Error{ErrProtocol, "Invalid target."}
+	}
+	r["token"] = s.token(from.IP, 0)
+	r["nodes"] = encodeNodes(s.table.closest(target, K))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[target]
+	if !ok {
+		return nil
+	}
+	if time.Since(it.stored) > ItemTTL {
+		delete(s.items, target)
+		return nil
+	}
+	if m := it.mutable; m != nil {
+		r["k"] = string(m.K)
+		r["seq"] = m.Seq
+		r["sig"] = string(m.Sig)
+		// The asker already has this version or a newer one.
+		if seq, ok := a["seq"].(int64); ok && m.Seq <= seq {
+			return nil
+		}
+	}
+	r["v"] = it.v
+	return nil
+}
+
+func (s *Server) handlePut(a map[string]interface{}, from *net.UDPAddr) *Error {
+	token, _ := a["token"].(string)
+	if token != s.token(from.IP, 0) && token != s.token(from.IP, 1) {
+		return &Error{ErrProtocol, "Bad token."}
+	}
+	v, ok := a["v"]
+	if !ok {
+		return &Error{ErrProtocol, "Missing value."}
+	}
+	b, err := encodeValue(v)
+	if err != nil {
+		return &Error{ErrMessageTooBig, "Message too big."}
+	}
+	it := &storedItem{v: v, stored: time.Now()}
+	var target ID
+	k, mutable := a["k"].(string)
+	if !mutable {
+		target = sha1.Sum(b)
+	} else {
+		m := &MutableItem{V: v, K: ed25519.PublicKey(k)}
+		m.Salt, _ = a["salt"].(string)
+		m.Seq, _ = a["seq"].(int64)
+		sig, _ := a["sig"].(string)
+		m.Sig = []byte(sig)
+		if len(m.Salt) > MaxSaltSize {
+			return &Error{ErrSaltTooBig, "Salt too big."}
+		}
+		if m.Verify() != nil {
+			return &Error{ErrInvalidSignature, "Invalid signature."}
+		}
+		target = m.Target()
+		it.mutable = m
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.items[target]; ok && old.mutable != nil && it.mutable != nil && time.Since(old.stored) <= ItemTTL {
+		if cas, ok := a["cas"].(int64); ok && cas != old.mutable.Seq {
+			return &Error{ErrCASMismatch, "CAS mismatch."}
+		}
+		// An equal seq is only accepted for the same value, which
+		// refreshes the item.
+		if it.mutable.Seq < old.mutable.Seq || it.mutable.Seq == old.mutable.Seq && !sameValue(old.v, b) {
+			return &Error{ErrSeqTooLow, "Sequence number less than current."}
+		}
+	} else if !ok && len(s.items) >= maxItems {
+		s.expireItems()
+		if len(s.items) >= maxItems {
+			return &Error{ErrServer, "Storage full."}
+		}
+	}
+	s.items[target] = it
+	return nil
+}
+
+// sameValue reports whether v bencodes to b.
+func sameValue(v interface{}, b []byte) bool {
+	ob, err := encodeValue(v)
+	return err == nil && bytes.Equal(ob, b)
+}
+
+// expireItems drops items older than ItemTTL. s.mu must be held.
+func (s *Server) expireItems() {
+	for target, it := range s.items {
+		if time.Since(it.stored) > ItemTTL {
+			delete(s.items, target)
+		}
+	}
+}
+
+// PutImmutable stores v on the nodes closest to its target, which it
+// returns.
+func (s *Server) PutImmutable(ctx context.Context, v interface{}) (target ID, err error) {
+	if target, err = ImmutableTarget(v); err != nil {
+		return
+	}
+	if len(s.table.nodes()) == 0 {
+		return target, ErrNoNodes
+	}
+	nodes := s.lookup(ctx, target, "get", nil, nil)
+	err = s.store(ctx, nodes, "put", func() map[string]interface{} {
+		return map[string]interface{}{"v": v}
+	})
+	return
+}
+
+// GetImmutable looks up the immutable item stored under target.
+func (s *Server) GetImmutable(ctx context.Context, target ID) (v interface{}, err error) {
+	if len(s.table.nodes()) == 0 {
+		return nil, ErrNoNodes
+	}
+	found := false
+	s.lookup(ctx, target, "get", nil, func(r map[string]interface{}) {
+		if found {
+			return
+		}
+		if rv, ok := r["v"]; ok {
+			if t, err := ImmutableTarget(rv); err == nil && t == target {
+				v, found = rv, true
+			}
+		}
+	})
+	if !found {
+		if err = ctx.Err(); err == nil {
+			err = ErrItemNotFound
+		}
+	}
+	return
+}
+
+// PutMutable stores a signed item on the nodes closest to its target.
+func (s *Server) PutMutable(ctx context.Context, item *MutableItem) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	if len(s.table.nodes()) == 0 {
+		return ErrNoNodes
+	}
+	nodes := s.lookup(ctx, item.Target(), "get", nil, nil)
+	return s.store(ctx, nodes, "put", func() map[string]interface{} {
+		a := map[string]interface{}{
+			"v":   item.V,
+			"k":   string(item.K),
+			"seq": item.Seq,
+			"sig": string(item.Sig),
+		}
+		if item.Salt != "" {
+			a["salt"] = item.Salt
+		}
+		return a
+	})
+}
+
+// GetMutable looks up the mutable item of k and salt, returning the valid
+// version with the highest sequence number found.
+func (s *Server) GetMutable(ctx context.Context, k ed25519.PublicKey, salt string) (item *MutableItem, err error) {
+	if len(s.table.nodes()) == 0 {
+		return nil, ErrNoNodes
+	}
+	s.lookup(ctx, MutableTarget(k, salt), "get", nil, func(r map[string]interface{}) {
+		rv, ok := r["v"]
+		rk, _ := r["k"].(string)
+		if !ok || rk != string(k) {
+			return
+		}
+		m := &MutableItem{V: rv, K: k, Salt: salt}
+		m.Seq, _ = r["seq"].(int64)
+		sig, _ := r["sig"].(string)
+		m.Sig = []byte(sig)
+		if m.Verify() == nil && (item == nil || m.Seq > item.Seq) {
+			item = m
+		}
+	})
+	if item == nil {
+		if err = ctx.Err(); err == nil {
+			err = ErrItemNotFound
+		}
+	}
+	return
+}
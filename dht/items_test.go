@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestItemVectors(t *testing.T) {
+	// Test vectors from BEP 44.
+	target, err := ImmutableTarget("Hello World!")
+	if err != nil || target.String() != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("Immutable target %v, %v", target, err)
+	}
+	k, _ := hex.DecodeString("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	tests := []struct {
+		salt, sig, target string
+	}{
+		{"", "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			"4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"foobar", "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			"411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+	}
+	for _, test := range tests {
+		sig, _ := hex.DecodeString(test.sig)
+		m := &MutableItem{V: "Hello World!", K: k, Salt: test.salt, Seq: 1, Sig: sig}
+		if err := m.Verify(); err != nil {
+			t.Errorf("Salt %q: %v", test.salt, err)
+		}
+		if got := m.Target().String(); got != test.target {
+			t.Errorf("Salt %q: target %s, wanted %s", test.salt, got, test.target)
+		}
+		m.Seq = 2
+		if m.Verify() == nil {
+			t.Errorf("Salt %q: signature verified for another seq", test.salt)
+		}
+	}
+}
+
+func TestImmutableItems(t *testing.T) {
+	nodes := startNodes(t, 12)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	v := map[string]interface{}{"name": "feed", "n": int64(3), "l": []interface{}{"a", int64(1)}}
+	target, err := nodes[2].PutImmutable(ctx, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := nodes[9].GetImmutable(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Errorf("Got %v, wanted %v", got, v)
+	}
+	if _, err = nodes[9].GetImmutable(ctx, RandomID()); err != ErrItemNotFound {
+		t.Errorf("Wanted ErrItemNotFound, got %v", err)
+	}
+	big := make([]byte, MaxValueSize)
+	if _, err = nodes[2].PutImmutable(ctx, string(big)); err == nil {
+		t.Error("Oversized value accepted")
+	}
+}
+
+func TestMutableItems(t *testing.T) {
+	nodes := startNodes(t, 12)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq, v := range []string{"magnet:?xt=urn:btih:first", "magnet:?xt=urn:btih:second"} {
+		item, err := NewMutableItem(priv, v, "feed", int64(seq+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = nodes[1].PutMutable(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := nodes[7].GetMutable(ctx, pub, "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.V != "magnet:?xt=urn:btih:second" || got.Seq != 2 {
+		t.Errorf("Got %+v", got)
+	}
+	if _, err = nodes[7].GetMutable(ctx, pub, "other salt"); err != ErrItemNotFound {
+		t.Errorf("Wanted ErrItemNotFound, got %v", err)
+	}
+	// Nodes holding a newer version refuse older ones, and lookups
+	// prefer the newest.
+	old, _ := NewMutableItem(priv, "stale", "feed", 1)
+	nodes[4].PutMutable(ctx, old)
+	if got, err = nodes[7].GetMutable(ctx, pub, "feed"); err != nil || got.Seq != 2 {
+		t.Errorf("Got %+v, %v after stale put", got, err)
+	}
+	forged := *got
+	forged.V = "forged"
+	if err = forged.Verify(); err == nil {
+		t.Error("Forged item verified")
+	}
+}
+
+func TestPutValidation(t *testing.T) {
+	s := NewServer(newDiscardConn(), nil)
+	defer s.Close()
+	from := &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	token := s.token(from.IP, 0)
+	_, priv, _ := ed25519.GenerateKey(nil)
+	item, _ := NewMutableItem(priv, "v", "", 5)
+	older, _ := NewMutableItem(priv, "v", "", 4)
+	changed, _ := NewMutableItem(priv, "w", "", 5)
+	put := func(extra map[string]interface{}) *Error {
+		a := map[string]interface{}{"token": token, "v": item.V, "k": string(item.K), "seq": item.Seq, "sig": string(item.Sig)}
+		for k, v := range extra {
+			a[k] = v
+		}
+		return s.handlePut(a, from)
+	}
+	tests := []struct {
+		extra map[string]interface{}
+		code  int
+	}{
+		{map[string]interface{}{"token": "bad"}, ErrProtocol},
+		{map[string]interface{}{"sig": string(make([]byte, 64))}, ErrInvalidSignature},
+		{map[string]interface{}{"salt": string(make([]byte, 65))}, ErrSaltTooBig},
+		{map[string]interface{}{"v": string(make([]byte, MaxValueSize))}, ErrMessageTooBig},
+		{nil, 0},
+		{map[string]interface{}{"cas": int64(4)}, ErrCASMismatch},
+		{map[string]interface{}{"cas": int64(5)}, 0},
+		{map[string]interface{}{"seq": older.Seq, "sig": string(older.Sig)}, ErrSeqTooLow},
+		// An equal seq is rejected unless the value is the same.
+		{map[string]interface{}{"v": changed.V, "sig": string(changed.Sig)}, ErrSeqTooLow},
+		{nil, 0},
+	}
+	for _, test := range tests {
+		e := put(test.extra)
+		if (e == nil && test.code != 0) || (e != nil && e.Code != test.code) {
+			t.Errorf("%v: got %v, wanted %d", test.extra, e, test.code)
+		}
+	}
+	target := item.Target()
+	r := map[string]interface{}{}
+	s.handleGet(map[string]interface{}{"target": string(target[:]), "seq": int64(5)}, from, r)
+	if _, ok := r["v"]; ok || r["seq"] != int64(5) {
+		t.Errorf("Get with current seq returned %v", r)
+	}
+}
+
+// discardConn is a PacketConn that drops writes and blocks reads until
+// closed.
+type discardConn struct {
+	net.PacketConn
+	closed chan struct{}
+}
+
+func newDiscardConn() *discardConn {
+	return &discardConn{closed: make(chan struct{})}
+}
+
+func (c *discardConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	<-c.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (c *discardConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+func (c *discardConn) Close() error {
+	close(c.closed)
+	return nil
+}
@@ -0,0 +1,150 @@
+// Package dht implements a node of the mainline BitTorrent DHT (BEP 5): a
+// Kademlia routing table, the KRPC protocol over UDP and lookups of the
+// peers of a torrent, and the storage of arbitrary items (BEP 44). Only IPv4
+// is supported.
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ID identifies a node, or the info hash a lookup is for.
+type ID [20]byte
+
+// RandomID returns a random node id.
+func RandomID() (id ID) {
+	rand.Read(id[:])
+	return
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between two ids.
+func (id ID) Distance(other ID) (d ID) {
+	for i, _ := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b ID) bool {
+	da, db := target.Distance(a), target.Distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// NodeInfo is the contact information of a node.
+type NodeInfo struct {
+	ID   ID
+	Addr *net.UDPAddr
+}
+
+func (n NodeInfo) String() string {
+	return fmt.Sprintf("%v@%v", n.ID, n.Addr)
+}
+
+// KRPC error codes.
+const (
+	ErrGeneric       = 201
+	ErrServer        = 202
+	ErrProtocol      = 203
+	ErrMethodUnknown = 204
+)
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("DHT error %d: %s", e.Code, e.Msg)
+}
+
+const (
+	compactNodeLen = 26
+	compactPeerLen = 6
+)
+
+func encodeNodes(nodes []NodeInfo) string {
+	b := make([]byte, 0, compactNodeLen*len(nodes))
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		b = append(b, n.ID[:]...)
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint16(b, uint16(n.Addr.Port))
+	}
+	return string(b)
+}
+
+// decodeNodes parses compact node info; a trailing partial entry is
+// ignored.
+func decodeNodes(s string) (nodes []NodeInfo) {
+	for ; len(s) >= compactNodeLen; s = s[compactNodeLen:] {
+		var n NodeInfo
+		copy(n.ID[:], s)
+		n.Addr = &net.UDPAddr{IP: net.IP([]byte(s[20:24])), Port: int(binary.BigEndian.Uint16([]byte(s[24:26])))}
+		if n.Addr.Port != 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	return
+}
+
+func encodePeer(addr *net.TCPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(addr.Port)))
+}
+
+func decodePeer(s string) *net.TCPAddr {
+	if len(s) != compactPeerLen {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.IP([]byte(s[:4])), Port: int(binary.BigEndian.Uint16([]byte(s[4:])))}
+}
+
+// encodeMessage bencodes a KRPC message.
+func encodeMessage(m map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMessage(b []byte) (map[string]interface{}, error) {
+	v, err := bencode.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("KRPC message is not a dictionary.")
+	}
+	return m, nil
+}
+
+func getID(d map[string]interface{}, k string) (id ID, ok bool) {
+	s, ok := d[k].(string)
+	if !ok || len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
@@ -0,0 +1,630 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQueryTimeout is how long to wait for the answer to a query.
+	DefaultQueryTimeout = 2 * time.Second
+	// Alpha is the number of queries a lookup has in flight.
+	Alpha = 3
+	// PeerTTL is how long announced peers are kept.
+	PeerTTL = 30 * time.Minute
+
+	tokenRotation   = 5 * time.Minute
+	maxPeersPerHash = 1000
+	maxPeerHashes   = 10000
+	maxValues       = 50
+	maxPacket       = 64 * 1024
+)
+
+var (
+	ErrClosed  = errors.New("DHT node is closed.")
+	ErrTimeout = errors.New("DHT query timed out.")
+	ErrNoNodes = errors.New("No DHT nodes are known.")
+)
+
+// Config tunes a Server. The zero value is usable.
+type Config struct {
+	ID           ID            // A random id is used if zero.
+	QueryTimeout time.Duration // Zero means DefaultQueryTimeout.
+}
+
+// Server is a DHT node. It answers queries from other nodes and performs
+// lookups on behalf of the caller.
+type Server struct {
+	conn    net.PacketConn
+	id      ID
+	table   *table
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	peers   map[ID]map[string]time.Time // Announced peers by info hash.
+	items   map[ID]*storedItem          // BEP 44 items by target.
+	secrets [2][16]byte
+	rotated time.Time
+	done    chan struct{}
+	closed  bool
+}
+
+type pendingQuery struct {
+	addr string
+	ch   chan *response
+}
+
+type response struct {
+	r   map[string]interface{}
+	err error
+}
+
+// Listen starts a node on a UDP address such as ":6881".
+func Listen(addr string, cfg *Config) (*Server, error) {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(conn, cfg), nil
+}
+
+// NewServer starts a node on conn; cfg may be nil. The node owns conn and
+// closes it on Close.
+func NewServer(conn net.PacketConn, cfg *Config) *Server {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	s := &Server{
+		conn:    conn,
+		id:      cfg.ID,
+		timeout: cfg.QueryTimeout,
+		pending: make(map[string]*pendingQuery),
+		peers:   make(map[ID]map[string]time.Time),
+		items:   make(map[ID]*storedItem),
+		done:    make(chan struct{}),
+	}
+	if s.id == (ID{}) {
+		s.id = RandomID()
+	}
+	if s.timeout <= 0 {
+		s.timeout = DefaultQueryTimeout
+	}
+	s.table = newTable(s.id)
+	go s.serve()
+	return s
+}
+
+func (s *Server) ID() ID {
+	return s.id
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Nodes returns the good and questionable nodes of the routing table.
+func (s *Server) Nodes() []NodeInfo {
+	return s.table.nodes()
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		if ua, ok := addr.(*net.UDPAddr); ok && ua.IP.To4() != nil {
+			s.handle(buf[:n], &net.UDPAddr{IP: ua.IP.To4(), Port: ua.Port})
+		}
+	}
+}
+
+func (s *Server) handle(b []byte, from *net.UDPAddr) {
+	m, err := decodeMessage(b)
+	if err != nil {
+		return
+	}
+	t, _ := m["t"].(string)
+	switch y, _ := m["y"].(string); y {
+	case "q":
+		s.handleQuery(m, t, from)
+	case "r", "e":
+		s.mu.Lock()
+		p, ok := s.pending[t]
+		if ok && p.addr == from.String() {
+			delete(s.pending, t)
+		} else {
+			ok = false
+		}
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+		resp := new(response)
+		if y == "r" {
+			resp.r, _ = m["r"].(map[string]interface{})
+			id, ok := getID(resp.r, "id")
+			if !ok {
+				resp.err = errors.New("DHT response has no valid node id.")
+			} else {
+				s.addNode(NodeInfo{id, from})
+			}
+		} else {
+			e := &Error{Code: ErrGeneric}
+			if l, ok := m["e"].([]interface{}); ok && len(l) == 2 {
+				code, _ := l[0].(int64)
+				e.Code = int(code)
+				e.Msg, _ = l[1].(string)
+			}
+			resp.err = e
+		}
+		p.ch <- resp
+	}
+}
+
+func (s *Server) send(to *net.UDPAddr, m map[string]interface{}) error {
+	b, err := encodeMessage(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(b, to)
+	return err
+}
+
+func (s *Server) sendError(to *net.UDPAddr, t string, code int, msg string) {
+	s.send(to, map[string]interface{}{"t": t, "y": "e", "e": []interface{}{code, msg}})
+}
+
+func (s *Server) handleQuery(m map[string]interface{}, t string, from *net.UDPAddr) {
+	a, _ := m["a"].(map[string]interface{})
+	id, ok := getID(a, "id")
+	if !ok {
+		s.sendError(from, t, ErrProtocol, "Invalid node id.")
+		return
+	}
+	if ro, _ := m["ro"].(int64); ro != 1 {
+		s.addNode(NodeInfo{id, from})
+	}
+	r := map[string]interface{}{"id": string(s.id[:])}
+	switch q, _ := m["q"].(string); q {
+	case "ping":
+	case "find_node":
+		target, ok := getID(a, "target")
+		if !ok {
+			s.sendError(from, t, ErrProtocol, "Invalid target.")
+			return
+		}
+		r["nodes"] = encodeNodes(s.table.closest(target, K))
+	case "get_peers":
+		ih, ok := getID(a, "info_hash")
+		if !ok {
+			s.sendError(from, t, ErrProtocol, "Invalid info hash.")
+			return
+		}
+		r["token"] = s.token(from.IP, 0)
+		if values := s.values(ih); len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = encodeNodes(s.table.closest(ih, K))
+		}
+	case "announce_peer":
+		ih, ok := getID(a, "info_hash")
+		token, _ := a["token"].(string)
+		port, _ := a["port"].(int64)
+		if implied, _ := a["implied_port"].(int64); implied == 1 {
+			port = int64(from.Port)
+		}
+		if !ok || port <= 0 || port > 65535 {
+			s.sendError(from, t, ErrProtocol, "Invalid announce.")
+			return
+		}
+		if token != s.token(from.IP, 0) && token != s.token(from.IP, 1) {
+			s.sendError(from, t, ErrProtocol, "Bad token.")
+			return
+		}
+		s.storePeer(ih, &net.TCPAddr{IP: from.IP, Port: int(port)})
+	case "get":
+		if e := s.handleGet(a, from, r); e != nil {
+			s.sendError(from, t, e.Code, e.Msg)
+			return
+		}
+	case "put":
+		if e := s.handlePut(a, from); e != nil {
+			s.sendError(from, t, e.Code, e.Msg)
+			return
+		}
+	default:
+		s.sendError(from, t, ErrMethodUnknown, "Method unknown.")
+		return
+	}
+	s.send(from, map[string]interface{}{"t": t, "y": "r", "r": r})
+}
+
+// token returns the announce token for ip under the current (0) or
+// previous (1) secret.
+func (s *Server) token(ip net.IP, i int) string {
+	s.mu.Lock()
+	if now := time.Now(); now.Sub(s.rotated) >= tokenRotation {
+		s.secrets[1] = s.secrets[0]
+		rand.Read(s.secrets[0][:])
+		if s.rotated.IsZero() {
+			s.secrets[1] = s.secrets[0]
+		}
+		s.rotated = now
+	}
+	secret := s.secrets[i]
+	s.mu.Unlock()
+	h := sha1.New()
+	h.Write(ip.To4())
+	h.Write(secret[:])
+	return string(h.Sum(nil)[:8])
+}
+
+func (s *Server) storePeer(ih ID, addr *net.TCPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, ok := s.peers[ih]
+	if !ok {
+		if len(s.peers) >= maxPeerHashes {
+			s.expirePeers()
+			if len(s.peers) >= maxPeerHashes {
+				return
+			}
+		}
+		peers = make(map[string]time.Time)
+		s.peers[ih] = peers
+	}
+	key := encodePeer(addr)
+	if _, ok := peers[key]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+	peers[key] = time.Now()
+}
+
+// expirePeers drops peers announced more than PeerTTL ago, and info hashes
+// left without peers. s.mu must be held.
+func (s *Server) expirePeers() {
+	now := time.Now()
+	for ih, peers := range s.peers {
+		for key, seen := range peers {
+			if now.Sub(seen) > PeerTTL {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, ih)
+		}
+	}
+}
+
+// values returns the compact addresses of up to maxValues live peers of
+// ih, dropping expired ones.
+func (s *Server) values(ih ID) (r []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, seen := range s.peers[ih] {
+		if now.Sub(seen) > PeerTTL {
+			delete(s.peers[ih], key)
+			continue
+		}
+		if len(r) < maxValues {
+			r = append(r, key)
+		}
+	}
+	if len(s.peers[ih]) == 0 {
+		delete(s.peers, ih)
+	}
+	return
+}
+
+// query sends a query to addr and waits for the answer.
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, q string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(s.id[:])
+	p := &pendingQuery{addr: addr.String(), ch: make(chan *response, 1)}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	// Random transaction ids keep off-path nodes from forging answers.
+	var t string
+	for {
+		var tx [4]byte
+		rand.Read(tx[:])
+		t = string(tx[:])
+		if _, ok := s.pending[t]; !ok {
+			break
+		}
+	}
+	s.pending[t] = p
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+	if err := s.send(addr, map[string]interface{}{"t": t, "y": "q", "q": q, "a": args}); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-p.ch:
+		return resp.r, resp.err
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, ErrClosed
+	}
+}
+
+// addNode adds n to the routing table, pinging the questionable node that
+// n may replace.
+func (s *Server) addNode(n NodeInfo) {
+	if _, ping := s.table.add(n); ping != nil {
+		go s.pingQuestionable(*ping)
+	}
+}
+
+// pingQuestionable pings n up to maxFailures times. An answer refreshes it
+// in the table; once it failed every ping, it is replaced.
+func (s *Server) pingQuestionable(n NodeInfo) {
+	defer s.table.pinged(n.ID)
+	for i := 0; i < maxFailures; i++ {
+		_, err := s.query(context.Background(), n.Addr, "ping", map[string]interface{}{})
+		if _, answered := err.(*Error); err == nil || answered || err == ErrClosed {
+			return
+		}
+		s.table.failed(n.ID)
+	}
+}
+
+// Ping queries the node at addr and returns its id.
+func (s *Server) Ping(ctx context.Context, addr string) (id ID, err error) {
+	ua, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return
+	}
+	r, err := s.query(ctx, ua, "ping", map[string]interface{}{})
+	if err != nil {
+		return
+	}
+	id, _ = getID(r, "id")
+	return
+}
+
+// Bootstrap fills the routing table starting from the nodes at addrs, such
+// as well known routers or the "nodes" of a trackerless torrent, given as
+// host:port.
+func (s *Server) Bootstrap(ctx context.Context, addrs ...string) error {
+	var mu sync.Mutex
+	var seeds []NodeInfo
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		ua, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(ua *net.UDPAddr) {
+			defer wg.Done()
+			r, err := s.query(ctx, ua, "find_node", map[string]interface{}{"target": string(s.id[:])})
+			if err != nil {
+				return
+			}
+			nodes, _ := r["nodes"].(string)
+			mu.Lock()
+			seeds = append(seeds, decodeNodes(nodes)...)
+			mu.Unlock()
+		}(ua)
+	}
+	wg.Wait()
+	s.lookup(ctx, s.id, "find_node", seeds, nil)
+	if len(s.table.nodes()) == 0 {
+		return ErrNoNodes
+	}
+	return nil
+}
+
+// lookupNode is a candidate of an iterative lookup.
+type lookupNode struct {
+	NodeInfo
+	queried bool
+	failed  bool
+	token   string
+}
+
+// lookup converges on the K nodes closest to target, sending q to Alpha
+// nodes at a time, starting from the routing table and seeds. It returns
+// the closest nodes that answered. visit, if not nil, is called with each
+// response; calls are serialised.
+func (s *Server) lookup(ctx context.Context, target ID, q string, seeds []NodeInfo, visit func(r map[string]interface{})) (res []*lookupNode) {
+	var cands []*lookupNode
+	seen := map[ID]bool{s.id: true}
+	addCand := func(n NodeInfo) {
+		if !seen[n.ID] && n.Addr.IP.To4() != nil && n.Addr.Port != 0 {
+			seen[n.ID] = true
+			cands = append(cands, &lookupNode{NodeInfo: n})
+		}
+	}
+	for _, n := range append(s.table.closest(target, K), seeds...) {
+		addCand(n)
+	}
+	var mu sync.Mutex
+	for ctx.Err() == nil {
+		sort.Slice(cands, func(i, j int) bool { return closer(target, cands[i].ID, cands[j].ID) })
+		var batch []*lookupNode
+		live := 0
+		for _, c := range cands {
+			if live == K || len(batch) == Alpha {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			live++
+			if !c.queried {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c *lookupNode) {
+				defer wg.Done()
+				key := "target"
+				if q == "get_peers" {
+					key = "info_hash"
+				}
+				r, err := s.query(ctx, c.Addr, q, map[string]interface{}{key: string(target[:])})
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					c.failed = true
+					if err == ErrTimeout {
+						s.table.failed(c.ID)
+					}
+					return
+				}
+				c.token, _ = r["token"].(string)
+				nodes, _ := r["nodes"].(string)
+				for _, n := range decodeNodes(nodes) {
+					addCand(n)
+				}
+				if visit != nil {
+					visit(r)
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+	for _, c := range cands {
+		if len(res) == K {
+			break
+		}
+		if c.queried && !c.failed {
+			res = append(res, c)
+		}
+	}
+	return
+}
+
+// GetPeers looks up the peers of the torrent with info hash ih.
+func (s *Server) GetPeers(ctx context.Context, ih ID) ([]*net.TCPAddr, error) {
+	if len(s.table.nodes()) == 0 {
+		return nil, ErrNoNodes
+	}
+	peers := s.lookupPeers(ctx, ih)
+	return peers.values, ctx.Err()
+}
+
+type peerLookup struct {
+	nodes  []*lookupNode
+	values []*net.TCPAddr
+	seen   map[string]bool
+}
+
+// lookupPeers runs a get_peers lookup, collecting the peers returned.
+func (s *Server) lookupPeers(ctx context.Context, ih ID) (res peerLookup) {
+	res.seen = make(map[string]bool)
+	res.nodes = s.lookup(ctx, ih, "get_peers", nil, func(r map[string]interface{}) {
+		values, _ := r["values"].([]interface{})
+		for _, v := range values {
+			vs, _ := v.(string)
+			if p := decodePeer(vs); p != nil && !res.seen[vs] {
+				res.seen[vs] = true
+				res.values = append(res.values, p)
+			}
+		}
+	})
+	return
+}
+
+// Announce looks up the peers of ih and announces that we accept
+// connections for it on port, or on the port of our DHT socket if port is
+// zero. It returns the peers found by the lookup.
+func (s *Server) Announce(ctx context.Context, ih ID, port int) ([]*net.TCPAddr, error) {
+	if len(s.table.nodes()) == 0 {
+		return nil, ErrNoNodes
+	}
+	res := s.lookupPeers(ctx, ih)
+	err := s.store(ctx, res.nodes, "announce_peer", func() map[string]interface{} {
+		args := map[string]interface{}{"info_hash": string(ih[:]), "port": port}
+		if port == 0 {
+			args["implied_port"] = 1
+		}
+		return args
+	})
+	return res.values, err
+}
+
+// store sends q to every node that gave us a token, with the arguments
+// returned by args and the node's token. It fails if no node accepted.
+func (s *Server) store(ctx context.Context, nodes []*lookupNode, q string, args func() map[string]interface{}) (err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n *lookupNode) {
+			defer wg.Done()
+			a := args()
+			a["token"] = n.token
+			_, qerr := s.query(ctx, n.Addr, q, a)
+			mu.Lock()
+			defer mu.Unlock()
+			if qerr == nil {
+				accepted++
+			} else if _, ok := qerr.(*Error); ok {
+				// Report why remote nodes refused.
+				err = qerr
+			}
+		}(n)
+	}
+	wg.Wait()
+	if accepted > 0 {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = fmt.Errorf("No DHT node accepted %s.", q)
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the size of a routing table bucket and the number of nodes a lookup
+// converges on.
+const K = 8
+
+const (
+	// maxFailures is the number of unanswered queries after which a node
+	// is bad and may be replaced.
+	maxFailures = 2
+	// questionableAfter is how long a node stays good without activity.
+	questionableAfter = 15 * time.Minute
+)
+
+type tableNode struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+	pinging  bool // A ping was handed out by add and is not done yet.
+}
+
+// table is a Kademlia routing table with one bucket per length of the
+// prefix shared with our own id.
+type table struct {
+	self ID
+
+	mu           sync.Mutex
+	buckets      [160][]*tableNode // Least recently seen first.
+	replacements [160][]NodeInfo   // Candidates for full buckets, newest last.
+	now          func() time.Time
+}
+
+func newTable(self ID) *table {
+	return &table{self: self, now: time.Now}
+}
+
+// bucketIndex returns the number of leading bits id shares with t.self, or
+// -1 for t.self itself.
+func (t *table) bucketIndex(id ID) int {
+	d := t.self.Distance(id)
+	for i, b := range d {
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>uint(j)) != 0 {
+				return i*8 + j
+			}
+		}
+	}
+	return -1
+}
+
+// add records that n is alive. It reports whether n is in the table. When
+// the bucket of n is full and has no bad node, n is kept as a replacement
+// and the least recently seen questionable node, if any, is returned. The
+// caller pings it, reporting the outcome with failed and pinged; the node
+// is replaced only once it has become bad, as BEP 5 asks.
+func (t *table) add(n NodeInfo) (added bool, ping *NodeInfo) {
+	i := t.bucketIndex(n.ID)
+	if i < 0 || n.Addr == nil || n.Addr.IP.To4() == nil || n.Addr.Port == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, e := range b {
+		if e.ID == n.ID {
+			e.Addr, e.lastSeen, e.failures = n.Addr, t.now(), 0
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), e)
+			return true, nil
+		}
+	}
+	e := &tableNode{NodeInfo: n, lastSeen: t.now()}
+	if len(b) < K {
+		t.buckets[i] = append(b, e)
+		return true, nil
+	}
+	for j, old := range b {
+		if old.failures >= maxFailures {
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), e)
+			return true, nil
+		}
+	}
+	t.addReplacement(i, n)
+	for _, old := range b {
+		if !old.pinging && t.now().Sub(old.lastSeen) >= questionableAfter {
+			old.pinging = true
+			info := old.NodeInfo
+			return false, &info
+		}
+	}
+	return
+}
+
+// addReplacement remembers n for bucket i. t.mu must be held.
+func (t *table) addReplacement(i int, n NodeInfo) {
+	r := t.replacements[i]
+	for j, old := range r {
+		if old.ID == n.ID {
+			r = append(r[:j:j], r[j+1:]...)
+			break
+		}
+	}
+	if len(r) == K {
+		r = r[1:]
+	}
+	t.replacements[i] = append(r, n)
+}
+
+// failed records an unanswered query to id. A node that becomes bad is
+// replaced by the newest replacement of its bucket.
+func (t *table) failed(id ID) {
+	i := t.bucketIndex(id)
+	if i < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, e := range b {
+		if e.ID != id {
+			continue
+		}
+		e.failures++
+		if e.failures < maxFailures {
+			return
+		}
+		for r := t.replacements[i]; len(r) > 0; r = t.replacements[i] {
+			n := r[len(r)-1]
+			t.replacements[i] = r[:len(r)-1]
+			if !t.contains(i, n.ID) {
+				t.buckets[i] = append(append(b[:j:j], b[j+1:]...), &tableNode{NodeInfo: n, lastSeen: t.now()})
+				return
+			}
+		}
+		return
+	}
+}
+
+// contains reports whether bucket i holds id. t.mu must be held.
+func (t *table) contains(i int, id ID) bool {
+	for _, e := range t.buckets[i] {
+		if e.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pinged ends a ping handed out by add.
+func (t *table) pinged(id ID) {
+	i := t.bucketIndex(id)
+	if i < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range t.buckets[i] {
+		if e.ID == id {
+			e.pinging = false
+		}
+	}
+}
+
+// closest returns up to n nodes that are not bad, nearest to target first.
+func (t *table) closest(target ID, n int) []NodeInfo {
+	all := t.nodes()
+	sort.Slice(all, func(i, j int) bool { return closer(target, all[i].ID, all[j].ID) })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// nodes returns every node that is not bad.
+func (t *table) nodes() (r []NodeInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.buckets {
+		for _, e := range b {
+			if e.failures < maxFailures {
+				r = append(r, e.NodeInfo)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package taipei
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"sync"
+)
+
+// DefaultMaxOpenFiles is the number of file descriptors a FileStore keeps
+// open at once when no explicit limit is given.
+const DefaultMaxOpenFiles = 64
+
+var errPoolClosed = errors.New("File pool is closed.")
+
+// filePool is a LRU cache of open file handles. Files are opened lazily on
+// first use and closed again when the pool is full and a handle for another
+// file is needed. Handles that are in use by a ReadAt or WriteAt are never
+// evicted; callers wait until one is released instead.
+type filePool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int
+	lru     *list.List // of *pooledFile, most recently used at the front
+	handles map[string]*list.Element
+	closed  bool
+}
+
+type pooledFile struct {
+	name    string
+	fd      *os.File
+	refs    int
+	opening bool // The slot is reserved while the file is being opened.
+}
+
+func newFilePool(max int) *filePool {
+	if max <= 0 {
+		max = DefaultMaxOpenFiles
+	}
+	p := &filePool{
+		max:     max,
+		lru:     list.New(),
+		handles: make(map[string]*list.Element),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// acquire returns an open handle for name, opening it if necessary. The
+// handle must be given back with release. The file is opened without
+// holding p.mu, so that a slow open does not stall users of other files.
+func (p *filePool) acquire(name string) (pf *pooledFile, err error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		if e, ok := p.handles[name]; ok {
+			pf = e.Value.(*pooledFile)
+			if pf.opening {
+				// Another caller is opening the file; wait for it.
+				p.cond.Wait()
+				continue
+			}
+			pf.refs++
+			p.lru.MoveToFront(e)
+			p.mu.Unlock()
+			return
+		}
+		if p.lru.Len() < p.max || p.evict() {
+			break
+		}
+		// Every open handle is busy; wait for one to be released.
+		p.cond.Wait()
+	}
+	// Reserve the slot; it cannot be evicted while refs is held.
+	pf = &pooledFile{name: name, refs: 1, opening: true}
+	e := p.lru.PushFront(pf)
+	p.handles[name] = e
+	p.mu.Unlock()
+
+	fd, err := os.OpenFile(name, os.O_RDWR, 0600)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.cond.Broadcast()
+	pf.opening = false
+	if p.closed {
+		// Close dropped the slot while we were opening.
+		if err == nil {
+			fd.Close()
+		}
+		return nil, errPoolClosed
+	}
+	if err != nil {
+		p.lru.Remove(e)
+		delete(p.handles, name)
+		return nil, err
+	}
+	pf.fd = fd
+	return
+}
+
+func (p *filePool) release(pf *pooledFile) {
+	p.mu.Lock()
+	pf.refs--
+	if pf.refs == 0 {
+		if p.closed {
+			pf.fd.Close()
+		}
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+}
+
+// evict closes the least recently used idle handle. It reports false if
+// every handle is in use. p.mu must be held.
+func (p *filePool) evict() bool {
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		pf := e.Value.(*pooledFile)
+		if pf.refs > 0 {
+			continue
+		}
+		p.lru.Remove(e)
+		delete(p.handles, pf.name)
+		pf.fd.Close()
+		return true
+	}
+	return false
+}
+
+// forget closes the handle for name, if any, so that the file can be
+// renamed. It waits for in-flight users of the handle.
+func (p *filePool) forget(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		e, ok := p.handles[name]
+		if !ok {
+			return
+		}
+		pf := e.Value.(*pooledFile)
+		if pf.refs == 0 {
+			p.lru.Remove(e)
+			delete(p.handles, name)
+			pf.fd.Close()
+			p.cond.Broadcast()
+			return
+		}
+		p.cond.Wait()
+	}
+}
+
+// open returns the number of currently open handles.
+func (p *filePool) open() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+// Close closes every idle handle. Handles still in use are closed as soon
+// as they are released.
+func (p *filePool) Close() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		pf := e.Value.(*pooledFile)
+		if pf.refs == 0 {
+			if cerr := pf.fd.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	p.lru.Init()
+	p.handles = make(map[string]*list.Element)
+	p.cond.Broadcast()
+	return
+}
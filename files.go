@@ -2,10 +2,12 @@ package taipei
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 type FileStore interface {
@@ -15,37 +17,104 @@ type FileStore interface {
 }
 
 type fileEntry struct {
+	mu     sync.RWMutex // Read-held during I/O, write-held while renaming.
 	length int64
 	fd     *os.File
+	name   string // Set when the file is opened on demand through the pool.
+	final  string // Set while the file is staged under name.
 }
 
+// fileStore is safe for concurrent use. ReadAt, WriteAt and CompletePiece
+// hold mu for reading, so Close waits for in-flight calls to finish; calls
+// made after Close fail with errStoreClosed.
 type fileStore struct {
+	mu      sync.RWMutex
+	closed  bool
 	offsets []int64
 	files   []fileEntry // Stored in increasing globalOffset order
+	pool    *filePool
+
+	verifyMu    sync.Mutex // Guards verified.
+	pieceLength int64
+	verified    *Bitset // Pieces reported through CompletePiece, when staging.
+}
+
+var errStoreClosed = errors.New("File store is closed.")
+
+// FileStoreOptions tunes a FileStore created by OpenFileStore. The zero
+// value gives the same behaviour as NewFileStore.
+type FileStoreOptions struct {
+	// MaxOpenFiles caps the number of file descriptors held open at once.
+	// Files are opened lazily on ReadAt/WriteAt and the least recently
+	// used ones are closed when the limit is reached. Zero means
+	// DefaultMaxOpenFiles.
+	MaxOpenFiles int
+	// Allocation selects how space is reserved for files that are
+	// created or grown. The default is AllocateSparse.
+	Allocation Allocation
+	// NoSpaceCheck skips the check that the files fit in the free space
+	// of the target filesystem.
+	NoSpaceCheck bool
+	// PartSuffix, when non-empty, is appended to the name of every file
+	// until all pieces overlapping it have been verified, at which point
+	// the file is renamed into place. See PieceCompleter.
+	PartSuffix string
+	// IncompleteDir, when non-empty, is a directory on the same
+	// filesystem as storePath that holds files until they are complete.
+	// It mirrors the layout below storePath and may be combined with
+	// PartSuffix.
+	IncompleteDir string
 }
 
-func (fe *fileEntry) open(name string, length int64) (err error) {
+func (o *FileStoreOptions) staging() bool {
+	return o.PartSuffix != "" || o.IncompleteDir != ""
+}
+
+// create makes sure the file exists with the given length, allocating space
+// as selected by alloc. The file is not kept open; it is opened through the
+// pool when needed.
+func (fe *fileEntry) create(name string, length int64, alloc Allocation) (err error) {
 	fe.length = length
-	st, err := os.Stat(name)
-	if err != nil && os.IsNotExist(err) {
-		fe.fd, err = os.Create(name)
-		if err != nil {
-			return
-		}
-	} else {
-		fe.fd, err = os.OpenFile(name, os.O_RDWR, 0600)
-		if st.Size() == length {
-			return
-		}
+	fe.name = name
+	fd, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
 	}
-	err = os.Truncate(name, length)
+	defer fd.Close()
+	st, err := fd.Stat()
 	if err != nil {
 		return
-		err = errors.New("Could not truncate file.")
+	}
+	size := st.Size()
+	if size == length {
+		return
+	}
+	if size > length || alloc == AllocateSparse {
+		if err = fd.Truncate(length); err != nil {
+			err = errors.New("Could not truncate file: " + err.Error())
+		}
+		return
+	}
+	switch alloc {
+	case AllocateFull:
+		err = fallocate(fd, size, length-size)
+	case AllocateZero:
+		err = zeroFill(fd, size, length)
+	default:
+		err = fmt.Errorf("Unknown allocation mode %v.", alloc)
 	}
 	return
 }
 
+func (fe *fileEntry) filename() string {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	if fe.fd != nil {
+		return fe.fd.Name()
+	}
+	return fe.name
+}
+
 func ensureDirectory(fullPath string) (err error) {
 	fullPath = path.Clean(fullPath)
 	if !strings.HasPrefix(fullPath, "/") {
@@ -65,29 +134,72 @@ func ensureDirectory(fullPath string) (err error) {
 }
 
 func NewFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
+	return OpenFileStore(info, storePath, nil)
+}
+
+// OpenFileStore is like NewFileStore but takes options; opts may be nil.
+//
+// With staging options, a file whose final name already exists is taken
+// as complete, so a reopened store picks up where it left off.
+func OpenFileStore(info *InfoDict, storePath string, opts *FileStoreOptions) (f FileStore, totalSize int64, err error) {
+	if opts == nil {
+		opts = &FileStoreOptions{}
+	}
 	fs := new(fileStore)
+	fs.pieceLength = info.PieceLength
 	numFiles := len(info.Files)
 	if numFiles == 0 {
 		// Create dummy Files structure.
 		info = &InfoDict{Files: []FileDict{FileDict{info.Length, []string{info.Name}, info.Md5sum}}}
 		numFiles = 1
 	}
+	staging := opts.staging()
+	if staging && fs.pieceLength <= 0 {
+		err = errors.New("Staging needs a positive piece length.")
+		return
+	}
+	spaceDir := storePath
+	if opts.IncompleteDir != "" {
+		spaceDir = opts.IncompleteDir
+	}
 	fs.files = make([]fileEntry, numFiles)
 	fs.offsets = make([]int64, numFiles)
 	for i, _ := range info.Files {
 		src := &info.Files[i]
-		fullPath := path.Join(storePath, path.Clean(path.Join(src.Path...)))
-		err = ensureDirectory(fullPath)
+		rel := path.Clean(path.Join(src.Path...))
+		entry := &fs.files[i]
+		entry.length = src.Length
+		entry.name = path.Join(storePath, rel)
+		if staging && src.Length > 0 {
+			if _, serr := os.Stat(entry.name); os.IsNotExist(serr) {
+				entry.final = entry.name
+				entry.name = path.Join(spaceDir, rel) + opts.PartSuffix
+			}
+		}
+		fs.offsets[i] = totalSize
+		totalSize += src.Length
+	}
+	if !opts.NoSpaceCheck {
+		if err = checkSpace(spaceDir, fs.files); err != nil {
+			return
+		}
+	}
+	for i, _ := range fs.files {
+		entry := &fs.files[i]
+		err = ensureDirectory(entry.name)
 		if err != nil {
 			return
 		}
-		err = fs.files[i].open(fullPath, src.Length)
+		err = entry.create(entry.name, entry.length, opts.Allocation)
 		if err != nil {
 			return
 		}
-		fs.offsets[i] = totalSize
-		totalSize += src.Length
 	}
+	if staging {
+		numPieces := (totalSize + fs.pieceLength - 1) / fs.pieceLength
+		fs.verified = NewBitset(int(numPieces))
+	}
+	fs.pool = newFilePool(opts.MaxOpenFiles)
 	f = fs
 	return
 }
@@ -97,13 +209,17 @@ func MkFileStore(fd *os.File) (fs FileStore, err error) {
 	if err != nil {
 		return
 	}
-	f := fileEntry{stat.Size(), fd}
-	return &fileStore{[]int64{0}, []fileEntry{f}}, nil
+	return &fileStore{offsets: []int64{0}, files: []fileEntry{{length: stat.Size(), fd: fd}}}, nil
 }
 
 func (f *fileStore) find(offset int64) int {
+	return findOffset(f.offsets, offset)
+}
+
+// findOffset returns the index of the file containing offset, given the
+// increasing start offsets of the files.
+func findOffset(offsets []int64, offset int64) int {
 	// Binary search
-	offsets := f.offsets
 	low := 0
 	high := len(offsets)
 	for low < high-1 {
@@ -118,7 +234,32 @@ func (f *fileStore) find(offset int64) int {
 	return low
 }
 
+// entryAt reads or writes p at off within a single file, holding the
+// entry's lock so that the file cannot be renamed or closed under us.
+func (f *fileStore) entryAt(entry *fileEntry, p []byte, off int64, write bool) (n int, err error) {
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+	fd := entry.fd
+	if f.pool != nil && entry.name != "" {
+		var pf *pooledFile
+		if pf, err = f.pool.acquire(entry.name); err != nil {
+			return
+		}
+		defer f.pool.release(pf)
+		fd = pf.fd
+	}
+	if write {
+		return fd.WriteAt(p, off)
+	}
+	return fd.ReadAt(p, off)
+}
+
 func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return 0, errStoreClosed
+	}
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -129,9 +270,8 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 			if space < chunk {
 				chunk = space
 			}
-			fd := entry.fd
 			var nThisTime int
-			nThisTime, err = fd.ReadAt(p[0:chunk], itemOffset)
+			nThisTime, err = f.entryAt(entry, p[0:chunk], itemOffset, false)
 			n = n + nThisTime
 			if err != nil {
 				return
@@ -150,6 +290,11 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return 0, errStoreClosed
+	}
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -160,9 +305,8 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 			if space < chunk {
 				chunk = space
 			}
-			fd := entry.fd
 			var nThisTime int
-			nThisTime, err = fd.WriteAt(p[0:chunk], itemOffset)
+			nThisTime, err = f.entryAt(entry, p[0:chunk], itemOffset, true)
 			n += nThisTime
 			if err != nil {
 				return
@@ -187,6 +331,12 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *fileStore) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
 	for i, _ := range f.files {
 		fd := f.files[i].fd
 		if fd != nil {
@@ -194,5 +344,8 @@ func (f *fileStore) Close() (err error) {
 			f.files[i].fd = nil
 		}
 	}
+	if f.pool != nil {
+		err = f.pool.Close()
+	}
 	return
 }
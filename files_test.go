@@ -1,9 +1,13 @@
 package taipei
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -33,8 +37,7 @@ func mkFileStore(tf testFile) (fs *fileStore, err error) {
 	if err != nil {
 		return fs, err
 	}
-	f := fileEntry{tf.fileLen, fd}
-	return &fileStore{[]int64{0}, []fileEntry{f}}, nil
+	return &fileStore{offsets: []int64{0}, files: []fileEntry{{length: tf.fileLen, fd: fd}}}, nil
 }
 
 func TestFileStoreRead(t *testing.T) {
@@ -56,3 +59,362 @@ func TestFileStoreRead(t *testing.T) {
 		}
 	}
 }
+
+func mkMultiInfo(n int, length int64) *InfoDict {
+	info := &InfoDict{Name: "multi"}
+	for i := 0; i < n; i++ {
+		info.Files = append(info.Files, FileDict{Length: length, Path: []string{"multi", fmt.Sprintf("%03d", i)}})
+	}
+	return info
+}
+
+func TestFileStorePool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := mkMultiInfo(16, 10)
+	f, size, err := OpenFileStore(info, dir, &FileStoreOptions{MaxOpenFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fs := f.(*fileStore)
+	if n := fs.pool.open(); n != 0 {
+		t.Errorf("Wanted no open files, got %d", n)
+	}
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err = f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.pool.open(); n > 3 {
+		t.Errorf("Wanted at most 3 open files, got %d", n)
+	}
+	ret := make([]byte, size)
+	if _, err = f.ReadAt(ret, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, ret) {
+		t.Errorf("Read back data does not match")
+	}
+	if n := fs.pool.open(); n > 3 {
+		t.Errorf("Wanted at most 3 open files, got %d", n)
+	}
+}
+
+func TestFilePoolOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a")
+	if err = ioutil.WriteFile(name, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := newFilePool(1)
+	defer p.Close()
+	// A failed open gives its slot back.
+	if _, err = p.acquire(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Opened a missing file")
+	}
+	if n := p.open(); n != 0 {
+		t.Errorf("Wanted no open files, got %d", n)
+	}
+	// Concurrent callers share a single handle.
+	var wg sync.WaitGroup
+	handles := make([]*pooledFile, 8)
+	for i, _ := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pf, err := p.acquire(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			handles[i] = pf
+		}(i)
+	}
+	wg.Wait()
+	for _, pf := range handles {
+		if pf == nil || pf != handles[0] || pf.fd == nil {
+			t.Fatalf("Got handles %v", handles)
+		}
+		p.release(pf)
+	}
+	if n := p.open(); n != 1 {
+		t.Errorf("Wanted 1 open file, got %d", n)
+	}
+}
+
+func TestFileStoreAllocation(t *testing.T) {
+	for _, alloc := range []Allocation{AllocateSparse, AllocateFull, AllocateZero} {
+		dir, err := ioutil.TempDir("", "taipei")
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := mkMultiInfo(3, 3<<20)
+		f, _, err := OpenFileStore(info, dir, &FileStoreOptions{Allocation: alloc})
+		if err != nil {
+			t.Fatalf("%v: %v", alloc, err)
+		}
+		f.Close()
+		for i, _ := range info.Files {
+			name := filepath.Join(dir, filepath.Join(info.Files[i].Path...))
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(data)) != info.Files[i].Length {
+				t.Errorf("%v: %s has size %d, wanted %d", alloc, name, len(data), info.Files[i].Length)
+			}
+			if bytes.Count(data, []byte{0}) != len(data) {
+				t.Errorf("%v: %s is not zeroed", alloc, name)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileStoreSpaceCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if free, _ := freeSpace(dir); free < 0 {
+		t.Skip("free space is unknown on this platform")
+	}
+	info := &InfoDict{Name: "huge", Length: 1 << 62}
+	_, _, err = NewFileStore(info, filepath.Join(dir, "sub"))
+	if _, ok := err.(*SpaceError); !ok {
+		t.Errorf("Wanted *SpaceError, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sub", "huge")); !os.IsNotExist(err) {
+		t.Errorf("File should not have been created")
+	}
+}
+
+func TestFileStoreStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Pieces of 10 bytes: file 0 spans pieces 0-1, file 1 spans 1-2 and
+	// file 2 lies in piece 2.
+	info := &InfoDict{Name: "stage", PieceLength: 10, Files: []FileDict{
+		{Length: 15, Path: []string{"a"}},
+		{Length: 10, Path: []string{"b"}},
+		{Length: 5, Path: []string{"c"}},
+	}}
+	opts := &FileStoreOptions{PartSuffix: ".part"}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	f, _, err := OpenFileStore(info, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("0123456789abcdefghijklmnopqrst"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a.part") || !exists("b.part") || !exists("c.part") || exists("a") {
+		t.Fatal("Wanted only staged files")
+	}
+	if err = f.(PieceCompleter).CompletePiece(2); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("c") || exists("c.part") || exists("b") {
+		t.Error("Wanted c renamed into place, b still staged")
+	}
+	f.Close()
+
+	// Reopen: c is complete, a and b keep their staged data.
+	f, _, err = OpenFileStore(info, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ret := make([]byte, 30)
+	if _, err = f.ReadAt(ret, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "0123456789abcdefghijklmnopqrst" {
+		t.Errorf("Got %q after reopen", ret)
+	}
+	if err = f.(PieceCompleter).CompletePiece(0); err != nil {
+		t.Fatal(err)
+	}
+	if exists("a") {
+		t.Error("a renamed before piece 1 completed")
+	}
+	if err = f.(PieceCompleter).CompletePiece(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.(PieceCompleter).CompletePiece(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if !exists(name) || exists(name+".part") {
+			t.Errorf("Wanted %s in place", name)
+		}
+	}
+	if _, err = f.ReadAt(ret, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "0123456789abcdefghijklmnopqrst" {
+		t.Errorf("Got %q after rename", ret)
+	}
+}
+
+func TestFileStoreIncompleteDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	final, incomplete := filepath.Join(dir, "final"), filepath.Join(dir, "incomplete")
+	// Pieces of 10 bytes: a lies in piece 0, sub/b spans pieces 1-2.
+	info := &InfoDict{Name: "stage", PieceLength: 10, Files: []FileDict{
+		{Length: 10, Path: []string{"a"}},
+		{Length: 15, Path: []string{"sub", "b"}},
+	}}
+	opts := &FileStoreOptions{IncompleteDir: incomplete}
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	data := "0123456789abcdefghijklmno"
+	f, _, err := OpenFileStore(info, final, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte(data), 0); err != nil {
+		t.Fatal(err)
+	}
+	staged := filepath.Join(incomplete, "sub", "b")
+	if !exists(filepath.Join(incomplete, "a")) || !exists(staged) || exists(filepath.Join(final, "a")) {
+		t.Fatal("Wanted files in the incomplete directory only")
+	}
+	if err = f.(PieceCompleter).CompletePiece(0); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(final, "a")) || exists(filepath.Join(incomplete, "a")) {
+		t.Error("Wanted a moved into the final directory")
+	}
+	if err = f.(PieceCompleter).CompletePiece(1); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash: the store is dropped without completing sub/b.
+	f.Close()
+
+	f, _, err = OpenFileStore(info, final, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ret := make([]byte, len(data))
+	if _, err = f.ReadAt(ret, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != data {
+		t.Errorf("Got %q after reopen", ret)
+	}
+	// Verification state is not persisted, so both pieces of sub/b are
+	// completed again.
+	for _, i := range []int{1, 2} {
+		if err = f.(PieceCompleter).CompletePiece(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !exists(filepath.Join(final, "sub", "b")) || exists(staged) {
+		t.Error("Wanted sub/b moved into the final directory")
+	}
+	if _, err = f.ReadAt(ret, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != data {
+		t.Errorf("Got %q after move", ret)
+	}
+}
+
+func TestFileStoreConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taipei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := mkMultiInfo(32, 100)
+	info.PieceLength = 64
+	f, size, err := OpenFileStore(info, dir, &FileStoreOptions{MaxOpenFiles: 4, PartSuffix: ".part"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numPieces := int((size + info.PieceLength - 1) / info.PieceLength)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			buf := make([]byte, info.PieceLength)
+			for i := g; i < numPieces; i += 8 {
+				off := int64(i) * info.PieceLength
+				for j := range buf {
+					buf[j] = byte(i)
+				}
+				if _, err := f.WriteAt(buf, off); err != nil {
+					t.Error(err)
+					return
+				}
+				ret := make([]byte, len(buf))
+				if _, err := f.ReadAt(ret, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if off+int64(len(buf)) <= size && !bytes.Equal(buf, ret) {
+					t.Errorf("Piece %d corrupted", i)
+				}
+				if err := f.(PieceCompleter).CompletePiece(i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	for i, _ := range info.Files {
+		name := filepath.Join(dir, filepath.Join(info.Files[i].Path...))
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Wanted %s in place: %v", name, err)
+		}
+	}
+
+	// Close while readers are running: reads either complete or fail
+	// cleanly with errStoreClosed.
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ret := make([]byte, size)
+			for {
+				if _, err := f.ReadAt(ret, 0); err != nil {
+					if err != errStoreClosed {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	if err = f.Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
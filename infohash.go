@@ -0,0 +1,165 @@
+package taipei
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// InfoHash is the SHA-1 hash of the bencoded info dictionary that identifies
+// a torrent.
+type InfoHash [sha1.Size]byte
+
+// InfoHashV2 is the SHA-256 info hash of a BitTorrent v2 torrent (BEP 52).
+type InfoHashV2 [sha256.Size]byte
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// String returns the hash as lower case hex.
+func (ih InfoHash) String() string {
+	return hex.EncodeToString(ih[:])
+}
+
+// Base32 returns the hash in the base32 form used by some magnet links.
+func (ih InfoHash) Base32() string {
+	return base32NoPad.EncodeToString(ih[:])
+}
+
+// URLEncoded returns the raw hash percent-encoded, as sent to trackers.
+func (ih InfoHash) URLEncoded() string {
+	return url.QueryEscape(string(ih[:]))
+}
+
+func (ih InfoHash) IsZero() bool {
+	return ih == InfoHash{}
+}
+
+// Compare orders hashes bytewise, returning -1, 0 or 1.
+func (ih InfoHash) Compare(other InfoHash) int {
+	return bytes.Compare(ih[:], other[:])
+}
+
+func (ih InfoHash) MarshalText() ([]byte, error) {
+	return []byte(ih.String()), nil
+}
+
+func (ih *InfoHash) UnmarshalText(text []byte) (err error) {
+	*ih, err = ParseInfoHash(string(text))
+	return
+}
+
+// ParseInfoHash parses a hash given as 40 hex digits or 32 base32
+// characters, in either case.
+func ParseInfoHash(s string) (ih InfoHash, err error) {
+	err = parseHash(ih[:], s)
+	return
+}
+
+// ParseInfoHashURL parses a percent-encoded raw hash, as found in tracker
+// requests.
+func ParseInfoHashURL(s string) (ih InfoHash, err error) {
+	raw, err := url.QueryUnescape(s)
+	if err != nil {
+		return
+	}
+	if len(raw) != len(ih) {
+		err = fmt.Errorf("Info hash has %d bytes, wanted %d.", len(raw), len(ih))
+		return
+	}
+	copy(ih[:], raw)
+	return
+}
+
+func (ih InfoHashV2) String() string {
+	return hex.EncodeToString(ih[:])
+}
+
+func (ih InfoHashV2) Base32() string {
+	return base32NoPad.EncodeToString(ih[:])
+}
+
+func (ih InfoHashV2) URLEncoded() string {
+	return url.QueryEscape(string(ih[:]))
+}
+
+// Multihash returns the hex multihash form used in "urn:btmh:" magnet
+// topics.
+func (ih InfoHashV2) Multihash() string {
+	return sha256Multihash + ih.String()
+}
+
+// Truncated returns the first 20 bytes of the hash, which stand in for the
+// info hash in the peer wire and tracker protocols (BEP 52).
+func (ih InfoHashV2) Truncated() (t InfoHash) {
+	copy(t[:], ih[:])
+	return
+}
+
+func (ih InfoHashV2) IsZero() bool {
+	return ih == InfoHashV2{}
+}
+
+func (ih InfoHashV2) Compare(other InfoHashV2) int {
+	return bytes.Compare(ih[:], other[:])
+}
+
+func (ih InfoHashV2) MarshalText() ([]byte, error) {
+	return []byte(ih.String()), nil
+}
+
+func (ih *InfoHashV2) UnmarshalText(text []byte) (err error) {
+	*ih, err = ParseInfoHashV2(string(text))
+	return
+}
+
+// ParseInfoHashV2 parses a v2 hash given as 64 hex digits, 52 base32
+// characters or a "1220" prefixed hex multihash.
+func ParseInfoHashV2(s string) (ih InfoHashV2, err error) {
+	if len(s) == len(sha256Multihash)+2*sha256.Size && strings.HasPrefix(s, sha256Multihash) {
+		s = s[len(sha256Multihash):]
+	}
+	err = parseHash(ih[:], s)
+	return
+}
+
+// Multihash prefix of a SHA-256 digest: function code 0x12, length 0x20.
+const sha256Multihash = "1220"
+
+// parseHash decodes s, in hex or unpadded base32, into h.
+func parseHash(h []byte, s string) (err error) {
+	var b []byte
+	switch len(s) {
+	case hex.EncodedLen(len(h)):
+		b, err = hex.DecodeString(s)
+	case base32NoPad.EncodedLen(len(h)):
+		b, err = base32NoPad.DecodeString(strings.ToUpper(s))
+	default:
+		return fmt.Errorf("Info hash %q has unexpected length %d, wanted %d or %d.",
+			s, len(s), hex.EncodedLen(len(h)), base32NoPad.EncodedLen(len(h)))
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid info hash %q: %v", s, err)
+	}
+	copy(h, b)
+	return nil
+}
+
+// parseBtih parses the value of a "urn:btih:" topic.
+func parseBtih(s string) (InfoHash, error) {
+	return ParseInfoHash(s)
+}
+
+// parseBtmh parses the value of a "urn:btmh:" topic, a hex encoded
+// multihash. Only SHA-256 is defined for BitTorrent v2.
+func parseBtmh(s string) (ih InfoHashV2, err error) {
+	if len(s) != len(sha256Multihash)+2*sha256.Size || !strings.HasPrefix(s, sha256Multihash) {
+		err = fmt.Errorf("Magnet URI contains unsupported multihash %v", s)
+		return
+	}
+	return ParseInfoHashV2(s)
+}
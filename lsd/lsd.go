@@ -0,0 +1,203 @@
+// Package lsd implements local service discovery (BEP 14): announcing the
+// torrents we serve to the local network over multicast and learning of
+// peers that do the same.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multicast groups of BEP 14.
+var (
+	Group4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	Group6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+const (
+	// MinAnnounceInterval is the least time between two announces of the
+	// same torrent, and between two reports of the same peer.
+	MinAnnounceInterval = time.Minute
+	// DefaultAnnounceInterval is how often torrents should be announced.
+	DefaultAnnounceInterval = 5 * time.Minute
+
+	maxMessage = 1400
+)
+
+var ErrClosed = errors.New("Local service discovery is closed.")
+
+// Service announces and discovers peers on one multicast group.
+type Service struct {
+	conn   net.PacketConn
+	group  *net.UDPAddr
+	port   int
+	cookie string
+	// OnPeer is called from Serve for each peer discovered, at most once
+	// per MinAnnounceInterval for a torrent and address.
+	OnPeer func(infoHash [20]byte, addr *net.TCPAddr)
+
+	mu     sync.Mutex
+	sent   map[[20]byte]time.Time
+	seen   map[string]time.Time
+	closed bool
+	now    func() time.Time
+}
+
+// Listen joins the IPv4 group on all interfaces, or on ifi if it is not
+// nil, to announce that we accept connections on port.
+func Listen(ifi *net.Interface, port int) (*Service, error) {
+	conn, err := net.ListenMulticastUDP("udp4", ifi, Group4)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn, Group4, port), nil
+}
+
+// New returns a Service sending announces to group over conn, which must
+// already receive the group's traffic.
+func New(conn net.PacketConn, group *net.UDPAddr, port int) *Service {
+	var c [8]byte
+	rand.Read(c[:])
+	return &Service{
+		conn:   conn,
+		group:  group,
+		port:   port,
+		cookie: hex.EncodeToString(c[:]),
+		sent:   make(map[[20]byte]time.Time),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (s *Service) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func (s *Service) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// Announce multicasts the given torrents. Torrents announced less than
+// MinAnnounceInterval ago are skipped.
+func (s *Service) Announce(infoHashes ...[20]byte) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	now := s.clock()
+	var due [][20]byte
+	for _, ih := range infoHashes {
+		if last, ok := s.sent[ih]; ok && now.Sub(last) < MinAnnounceInterval {
+			continue
+		}
+		s.sent[ih] = now
+		due = append(due, ih)
+	}
+	s.mu.Unlock()
+	for len(due) > 0 {
+		msg, n := s.message(due)
+		if _, err := s.conn.WriteTo(msg, s.group); err != nil {
+			return err
+		}
+		due = due[n:]
+	}
+	return nil
+}
+
+// message formats a BT-SEARCH announce for as many of infoHashes as fit in
+// one packet, returning how many it holds.
+func (s *Service) message(infoHashes [][20]byte) (b []byte, n int) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", s.group, s.port)
+	for n < len(infoHashes) && (n == 0 || buf.Len()+62+len(s.cookie) < maxMessage) {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", infoHashes[n][:])
+		n++
+	}
+	fmt.Fprintf(&buf, "cookie: %s\r\n\r\n\r\n", s.cookie)
+	return buf.Bytes(), n
+}
+
+// Serve reads announces until the Service is closed.
+func (s *Service) Serve() error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		s.handle(buf[:n], ua.IP)
+	}
+}
+
+func (s *Service) handle(pkt []byte, from net.IP) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(pkt)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+	if req.Header.Get("Cookie") == s.cookie {
+		// Our own announce, looped back.
+		return
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	addr := &net.TCPAddr{IP: from, Port: port}
+	for _, v := range req.Header["Infohash"] {
+		var ih [20]byte
+		b, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(b) != len(ih) {
+			continue
+		}
+		copy(ih[:], b)
+		if s.fresh(ih, addr) && s.OnPeer != nil {
+			s.OnPeer(ih, addr)
+		}
+	}
+}
+
+// fresh reports whether addr was not reported for ih recently.
+func (s *Service) fresh(ih [20]byte, addr *net.TCPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock()
+	key := string(ih[:]) + addr.String()
+	if last, ok := s.seen[key]; ok && now.Sub(last) < MinAnnounceInterval {
+		return false
+	}
+	if len(s.seen) > 10000 {
+		for k, t := range s.seen {
+			if now.Sub(t) >= MinAnnounceInterval {
+				delete(s.seen, k)
+			}
+		}
+	}
+	s.seen[key] = now
+	return true
+}
@@ -0,0 +1,169 @@
+package lsd
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hub stands in for a multicast group: every packet written by a member is
+// delivered to all members, the sender included.
+type hub struct {
+	mu      sync.Mutex
+	members []*hubConn
+}
+
+type hubConn struct {
+	net.PacketConn
+	hub  *hub
+	addr *net.UDPAddr
+	in   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (h *hub) join(ip string) *hubConn {
+	c := &hubConn{hub: h, addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 6771}, in: make(chan []byte, 64), done: make(chan struct{})}
+	h.mu.Lock()
+	h.members = append(h.members, c)
+	h.mu.Unlock()
+	return c
+}
+
+func (c *hubConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	for _, m := range c.hub.members {
+		select {
+		case m.in <- append([]byte(c.addr.IP.String()+"|"), b...):
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (c *hubConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		i := strings.IndexByte(string(p), '|')
+		return copy(b, p[i+1:]), &net.UDPAddr{IP: net.ParseIP(string(p[:i])), Port: 6771}, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *hubConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+type found struct {
+	ih   [20]byte
+	addr string
+}
+
+func newService(t *testing.T, h *hub, ip string, port int) (*Service, chan found) {
+	s := New(h.join(ip), Group4, port)
+	ch := make(chan found, 64)
+	s.OnPeer = func(ih [20]byte, addr *net.TCPAddr) { ch <- found{ih, addr.String()} }
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s, ch
+}
+
+func expect(t *testing.T, ch chan found, want ...found) {
+	for _, w := range want {
+		select {
+		case got := <-ch:
+			if got != w {
+				t.Errorf("Got %x at %s, wanted %x at %s", got.ih, got.addr, w.ih, w.addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", w.addr)
+		}
+	}
+	select {
+	case got := <-ch:
+		t.Errorf("Unexpected peer %x at %s", got.ih, got.addr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	h := new(hub)
+	a, aFound := newService(t, h, "192.168.1.10", 6881)
+	b, bFound := newService(t, h, "192.168.1.11", 51413)
+	now := time.Unix(1000, 0)
+	var mu sync.Mutex
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	a.now, b.now = clock, clock
+	ih1, ih2 := [20]byte{1}, [20]byte{2}
+
+	if err := a.Announce(ih1, ih2); err != nil {
+		t.Fatal(err)
+	}
+	// b learns of both torrents; a ignores its own announce.
+	expect(t, bFound, found{ih1, "192.168.1.10:6881"}, found{ih2, "192.168.1.10:6881"})
+	expect(t, aFound)
+
+	// Announces of the same torrent are rate limited.
+	a.Announce(ih1)
+	expect(t, bFound)
+	b.Announce(ih1)
+	expect(t, aFound, found{ih1, "192.168.1.11:51413"})
+
+	mu.Lock()
+	now = now.Add(MinAnnounceInterval)
+	mu.Unlock()
+	a.Announce(ih1)
+	expect(t, bFound, found{ih1, "192.168.1.10:6881"})
+}
+
+func TestMessage(t *testing.T) {
+	s := New(new(hub).join("10.0.0.1"), Group4, 6881)
+	ihs := make([][20]byte, 40)
+	for i := range ihs {
+		ihs[i][0] = byte(i)
+	}
+	msg, n := s.message(ihs[:1])
+	want := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n" +
+		"Infohash: 0000000000000000000000000000000000000000\r\ncookie: " + s.cookie + "\r\n\r\n\r\n"
+	if n != 1 || string(msg) != want {
+		t.Errorf("Got %q", msg)
+	}
+	total := 0
+	for rest := ihs; len(rest) > 0; rest = rest[n:] {
+		msg, n = s.message(rest)
+		if len(msg) > maxMessage {
+			t.Errorf("Message has %d bytes", len(msg))
+		}
+		total += n
+	}
+	if total != len(ihs) {
+		t.Errorf("Packed %d of %d torrents", total, len(ihs))
+	}
+	// Malformed announces are ignored.
+	s.OnPeer = func([20]byte, *net.TCPAddr) { t.Error("Malformed announce reported") }
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\nPort: 1\r\nInfohash: " + strings.Repeat("00", 20) + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + strings.Repeat("00", 20) + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 00\r\n\r\n",
+		"garbage",
+	} {
+		s.handle([]byte(bad), net.IP{10, 0, 0, 2})
+	}
+}
+
+func TestListen(t *testing.T) {
+	s, err := Listen(nil, 6881)
+	if err != nil {
+		t.Skip("Multicast unavailable:", err)
+	}
+	s.Close()
+}
@@ -0,0 +1,145 @@
+package taipei
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// memStore is a FileStore kept entirely in memory. Each file gets its own
+// buffer, allocated on first write; unwritten files read as zeros.
+type memStore struct {
+	mu      sync.RWMutex
+	closed  bool
+	offsets []int64
+	files   []memFile // Stored in increasing globalOffset order
+}
+
+var errNegativeOffset = errors.New("Negative offset.")
+
+type memFile struct {
+	length int64
+	data   []byte
+}
+
+// NewMemFileStore creates a FileStore backed by memory with the layout of
+// info. If maxSize is positive, torrents larger than maxSize bytes are
+// refused.
+func NewMemFileStore(info *InfoDict, maxSize int64) (f FileStore, totalSize int64, err error) {
+	ms := new(memStore)
+	numFiles := len(info.Files)
+	if numFiles == 0 {
+		// Create dummy Files structure.
+		info = &InfoDict{Files: []FileDict{FileDict{info.Length, []string{info.Name}, info.Md5sum}}}
+		numFiles = 1
+	}
+	ms.files = make([]memFile, numFiles)
+	ms.offsets = make([]int64, numFiles)
+	for i, _ := range info.Files {
+		length := info.Files[i].Length
+		if length < 0 {
+			err = errors.New("Negative file length.")
+			return
+		}
+		ms.files[i].length = length
+		ms.offsets[i] = totalSize
+		totalSize += length
+	}
+	if maxSize > 0 && totalSize > maxSize {
+		err = fmt.Errorf("Torrent size %d exceeds memory store limit %d.", totalSize, maxSize)
+		return
+	}
+	f = ms
+	return
+}
+
+func (m *memStore) ReadAt(p []byte, off int64) (n int, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, errStoreClosed
+	}
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	index := findOffset(m.offsets, off)
+	for len(p) > 0 && index < len(m.offsets) {
+		entry := &m.files[index]
+		itemOffset := off - m.offsets[index]
+		if itemOffset < entry.length {
+			chunk := entry.length - itemOffset
+			if int64(len(p)) < chunk {
+				chunk = int64(len(p))
+			}
+			if entry.data == nil {
+				for i := int64(0); i < chunk; i++ {
+					p[i] = 0
+				}
+			} else {
+				copy(p[:chunk], entry.data[itemOffset:])
+			}
+			n += int(chunk)
+			p = p[chunk:]
+			off += chunk
+		}
+		index++
+	}
+	// At this point if there's anything left to read it means we've run off the
+	// end of the file store. Read zeros. This is defined by the bittorrent protocol.
+	for i, _ := range p {
+		p[i] = 0
+	}
+	return
+}
+
+func (m *memStore) WriteAt(p []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, errStoreClosed
+	}
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	index := findOffset(m.offsets, off)
+	for len(p) > 0 && index < len(m.offsets) {
+		entry := &m.files[index]
+		itemOffset := off - m.offsets[index]
+		if itemOffset < entry.length {
+			chunk := entry.length - itemOffset
+			if int64(len(p)) < chunk {
+				chunk = int64(len(p))
+			}
+			if entry.data == nil {
+				entry.data = make([]byte, entry.length)
+			}
+			copy(entry.data[itemOffset:], p[:chunk])
+			n += int(chunk)
+			p = p[chunk:]
+			off += chunk
+		}
+		index++
+	}
+	// At this point if there's anything left to write it means we've run off the
+	// end of the file store. Check that the data is zeros.
+	// This is defined by the bittorrent protocol.
+	for i, _ := range p {
+		if p[i] != 0 {
+			err = errors.New("Unexpected non-zero data at end of store.")
+			n = n + i
+			return
+		}
+	}
+	n = n + len(p)
+	return
+}
+
+// Close releases the buffers. Later reads and writes fail.
+func (m *memStore) Close() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.files = nil
+	m.offsets = nil
+	return
+}
@@ -0,0 +1,74 @@
+package taipei
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMemFileStore(t *testing.T) {
+	m, err := GetMetaInfo("testData/test1.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("testData/" + m.Info.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = NewMemFileStore(&m.Info, m.Info.Length-1); err == nil {
+		t.Error("Wanted size limit error")
+	}
+	fs, size, err := NewMemFileStore(&m.Info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if size != int64(len(data)) {
+		t.Fatalf("Wanted size %d, got %d", len(data), size)
+	}
+	if _, err = fs.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	good, bad, err := CheckPieces(fs, size, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bad != 0 || good == 0 {
+		t.Errorf("Wanted all pieces good, got %d good, %d bad", good, bad)
+	}
+}
+
+func TestMemFileStoreLayout(t *testing.T) {
+	fs, size, err := NewMemFileStore(mkMultiInfo(3, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if size != 12 {
+		t.Fatalf("Wanted size 12, got %d", size)
+	}
+	if _, err = fs.WriteAt([]byte("abcdef"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// Writing zeros past the end is allowed, anything else is not.
+	if _, err = fs.WriteAt([]byte{'z', 0, 0}, 11); err != nil {
+		t.Error(err)
+	}
+	if _, err = fs.WriteAt([]byte{'z', 1}, 11); err == nil {
+		t.Error("Wanted error for non-zero data at end of store")
+	}
+	if _, err = fs.WriteAt([]byte("a"), -1); err == nil {
+		t.Error("Wanted error for a negative write offset")
+	}
+	ret := bytes.Repeat([]byte{'x'}, 16)
+	if _, err = fs.ReadAt(ret, -1); err == nil {
+		t.Error("Wanted error for a negative read offset")
+	}
+	if _, err = fs.ReadAt(ret, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("\x00\x00\x00abcdef\x00\x00z\x00\x00\x00\x00")
+	if !bytes.Equal(ret, want) {
+		t.Errorf("Wanted %q, got %q", want, ret)
+	}
+}
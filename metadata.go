@@ -0,0 +1,250 @@
+package taipei
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zyxar/taipei/wire"
+)
+
+// Fetching the info dictionary of a torrent from peers, as defined by the
+// ut_metadata extension (BEP 9).
+
+const (
+	metadataPieceSize = 16 * 1024
+	// MaxMetadataSize caps the info dictionary size accepted from peers.
+	MaxMetadataSize = 8 << 20
+
+	utMetadata = "ut_metadata"
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// DefaultPeerTimeout bounds a single metadata exchange with one peer when the
+// context has no earlier deadline.
+var DefaultPeerTimeout = 30 * time.Second
+
+// NewPeerID returns a random Azureus-style peer id.
+func NewPeerID() (id [20]byte) {
+	copy(id[:], "-TT0100-")
+	rand.Read(id[8:])
+	return
+}
+
+// MetaInfoFromMagnet parses a magnet URI and fetches its metadata from the
+// peers listed in x.pe and from peers.
+func MetaInfoFromMagnet(ctx context.Context, uri string, peers ...string) (*MetaInfo, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	return FetchMetaInfo(ctx, m, peers)
+}
+
+// FetchMetaInfo downloads the info dictionary of the first v1 info hash in m
+// from the peers given in m.Peers and peers, trying them in turn until one
+// delivers metadata matching the hash. The trackers of m are carried over to
+// the result.
+func FetchMetaInfo(ctx context.Context, m Magnet, peers []string) (*MetaInfo, error) {
+	if len(m.InfoHashes) == 0 {
+		return nil, errors.New("No bittorrent v1 infohashes found in the magnet link.")
+	}
+	addrs := append(append([]string(nil), m.Peers...), peers...)
+	if len(addrs) == 0 {
+		return nil, errors.New("No peers to fetch metadata from.")
+	}
+	ih := m.InfoHashes[0]
+	peerID := NewPeerID()
+	var lastErr error
+	for _, addr := range addrs {
+		info, err := fetchMetadataFrom(ctx, addr, ih, peerID)
+		if err == nil {
+			return metaInfoFromInfo(info, m)
+		}
+		lastErr = fmt.Errorf("%s: %v", addr, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// metaInfoFromInfo wraps a raw info dictionary into a MetaInfo.
+func metaInfoFromInfo(info []byte, m Magnet) (*MetaInfo, error) {
+	var buf bytes.Buffer
+	buf.WriteString("d4:info")
+	buf.Write(info)
+	buf.WriteString("e")
+	mi, err := DecodeMetaInfo(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Trackers) > 0 {
+		mi.Announce = m.Trackers[0]
+		for _, tr := range m.Trackers {
+			mi.AnnounceList = append(mi.AnnounceList, []string{tr})
+		}
+	}
+	mi.UrlList = m.WebSeeds
+	return mi, nil
+}
+
+func fetchMetadataFrom(ctx context.Context, addr string, ih InfoHash, peerID [20]byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultPeerTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock reads and writes if the context is cancelled early.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return fetchMetadata(conn, ih, peerID)
+}
+
+// metadataFetcher collects metadata pieces from one peer.
+type metadataFetcher struct {
+	ih       InfoHash
+	metadata []byte
+	have     *Bitset
+	done     bool
+}
+
+func (f *metadataFetcher) HandleExtendedHandshake(p *wire.ExtendedPeer) error {
+	if f.metadata != nil {
+		return nil
+	}
+	size := p.Remote().MetadataSize
+	if size <= 0 || size > MaxMetadataSize {
+		return fmt.Errorf("Peer announced invalid metadata size %d.", size)
+	}
+	f.metadata = make([]byte, size)
+	f.have = NewBitset((size + metadataPieceSize - 1) / metadataPieceSize)
+	// Ask for every piece at once; metadata is small.
+	for i := 0; i < f.have.Len(); i++ {
+		req, err := wire.EncodeDict(map[string]interface{}{"msg_type": metadataRequest, "piece": i}, nil)
+		if err != nil {
+			return err
+		}
+		if err = p.Send(utMetadata, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *metadataFetcher) HandleExtended(p *wire.ExtendedPeer, payload []byte) error {
+	if f.metadata == nil {
+		return errors.New("Peer sent metadata before its extended handshake.")
+	}
+	dict, data, err := wire.DecodeDict(payload)
+	if err != nil {
+		return err
+	}
+	msgType, _ := dict["msg_type"].(int64)
+	piece, ok := dict["piece"].(int64)
+	valid := ok && piece >= 0 && piece < int64(f.have.Len())
+	switch msgType {
+	case metadataRequest:
+		// We have no metadata to give yet.
+		rej, err := wire.EncodeDict(map[string]interface{}{"msg_type": metadataReject, "piece": piece}, nil)
+		if err != nil {
+			return err
+		}
+		return p.Send(utMetadata, rej)
+	case metadataReject:
+		// Rejects for pieces we never asked for are ignored.
+		if valid {
+			return fmt.Errorf("Peer rejected metadata piece %d.", piece)
+		}
+	case metadataData:
+		if !valid {
+			return errors.New("Peer sent metadata for an invalid piece.")
+		}
+		off := piece * metadataPieceSize
+		want := int64(len(f.metadata)) - off
+		if want > metadataPieceSize {
+			want = metadataPieceSize
+		}
+		if int64(len(data)) != want {
+			return fmt.Errorf("Metadata piece %d has %d bytes, wanted %d.", piece, len(data), want)
+		}
+		copy(f.metadata[off:], data)
+		f.have.Set(int(piece))
+		if f.have.All() {
+			if sha1.Sum(f.metadata) != [20]byte(f.ih) {
+				return errors.New("Metadata does not match the info hash.")
+			}
+			f.done = true
+		}
+	}
+	return nil
+}
+
+// fetchMetadata runs the ut_metadata exchange over an established
+// connection.
+func fetchMetadata(conn net.Conn, ih InfoHash, peerID [20]byte) ([]byte, error) {
+	h := wire.Handshake{InfoHash: ih, PeerID: peerID}
+	h.SetExtensions()
+	if err := wire.WriteHandshake(conn, &h); err != nil {
+		return nil, err
+	}
+	ph, err := wire.ReadHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if ph.InfoHash != h.InfoHash {
+		return nil, errors.New("Peer answered with a different info hash.")
+	}
+	if !ph.SupportsExtensions() {
+		return nil, errors.New("Peer does not support the extension protocol.")
+	}
+	f := &metadataFetcher{ih: ih}
+	reg := wire.NewRegistry()
+	if _, err = reg.Register(utMetadata, f); err != nil {
+		return nil, err
+	}
+	r, w := wire.NewReader(conn), wire.NewWriter(conn)
+	ep := reg.NewPeer(w)
+	ours := reg.Handshake()
+	ours.V = "taipei"
+	if err = ep.SendHandshake(ours); err != nil {
+		return nil, err
+	}
+	for !f.done {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.KeepAlive || msg.Type != wire.Extended {
+			continue
+		}
+		if err = ep.Handle(msg); err != nil {
+			return nil, err
+		}
+		if ep.Remote() != nil && !ep.Supports(utMetadata) {
+			return nil, errors.New("Peer does not support ut_metadata.")
+		}
+	}
+	return f.metadata, nil
+}
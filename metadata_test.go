@@ -0,0 +1,160 @@
+package taipei
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyxar/taipei/wire"
+)
+
+// seedMetadata answers ut_metadata requests for info on a single
+// connection, as a seeding peer would. If rejected is not nil, the seeder
+// also asks for metadata itself and reports the pieces it is refused.
+func seedMetadata(conn net.Conn, info []byte, rejected chan<- int64) error {
+	defer conn.Close()
+	h, err := wire.ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	h.PeerID = NewPeerID()
+	if err = wire.WriteHandshake(conn, &h); err != nil {
+		return err
+	}
+	r, w := wire.NewReader(conn), wire.NewWriter(conn)
+	reg := wire.NewRegistry()
+	probe := rejected != nil
+	// Register something first so that our ut_metadata id differs from
+	// the fetcher's.
+	reg.Register("x_other", wire.ExtensionHandlerFunc(func(*wire.ExtendedPeer, []byte) error { return nil }))
+	reg.Register(utMetadata, wire.ExtensionHandlerFunc(func(p *wire.ExtendedPeer, payload []byte) error {
+		dict, _, err := wire.DecodeDict(payload)
+		if err != nil {
+			return err
+		}
+		piece, _ := dict["piece"].(int64)
+		if msgType, _ := dict["msg_type"].(int64); msgType != metadataRequest {
+			if msgType == metadataReject && rejected != nil {
+				rejected <- piece
+			}
+			return nil
+		}
+		if probe {
+			// Ask the fetcher for a piece, and refuse one it never asked for.
+			for _, m := range []map[string]interface{}{
+				{"msg_type": metadataRequest, "piece": 0},
+				{"msg_type": metadataReject, "piece": 99},
+			} {
+				req, err := wire.EncodeDict(m, nil)
+				if err != nil {
+					return err
+				}
+				if err = p.Send(utMetadata, req); err != nil {
+					return err
+				}
+			}
+			probe = false
+		}
+		start := piece * metadataPieceSize
+		end := start + metadataPieceSize
+		if end > int64(len(info)) {
+			end = int64(len(info))
+		}
+		resp, err := wire.EncodeDict(map[string]interface{}{"msg_type": metadataData, "piece": piece, "total_size": len(info)}, info[start:end])
+		if err != nil {
+			return err
+		}
+		return p.Send(utMetadata, resp)
+	}))
+	ep := reg.NewPeer(w)
+	ours := reg.Handshake()
+	ours.MetadataSize = len(info)
+	if err = ep.SendHandshake(ours); err != nil {
+		return err
+	}
+	// Unrelated traffic is ignored by the fetcher.
+	if err = w.WriteMessage(&wire.Message{Type: wire.Bitfield, Bitfield: []byte{0xff}}); err != nil {
+		return err
+	}
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msg.Type == wire.Extended {
+			if err = ep.Handle(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func listenSeeder(t *testing.T, info []byte, rejected chan<- int64) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go seedMetadata(conn, info, rejected)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestFetchMetaInfo(t *testing.T) {
+	// Large enough to span several metadata pieces.
+	pieces := strings.Repeat("0123456789abcdefghij", 2000)
+	info := []byte("d6:lengthi1024e4:name9:test1.zip12:piece lengthi32768e6:pieces40000:" + pieces + "e")
+	ih := InfoHash(sha1.Sum(info))
+	addr := listenSeeder(t, info, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	uri := Magnet{InfoHashes: []InfoHash{ih}, Trackers: []string{"udp://t.example.com:80"}, Peers: []string{addr}}.String()
+	m, err := MetaInfoFromMagnet(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoHash != ih || m.Info.Name != "test1.zip" || m.Info.Pieces != pieces {
+		t.Errorf("Got wrong metainfo %v", m)
+	}
+	if m.Announce != "udp://t.example.com:80" {
+		t.Errorf("Announce = %q", m.Announce)
+	}
+
+	// A peer serving other metadata under the same hash is rejected.
+	bad := listenSeeder(t, bytes.Replace(info, []byte("test1"), []byte("test2"), 1), nil)
+	_, err = FetchMetaInfo(ctx, Magnet{InfoHashes: []InfoHash{ih}}, []string{bad})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Wanted hash mismatch, got %v", err)
+	}
+	// The next peer is tried after a failure.
+	if _, err = FetchMetaInfo(ctx, Magnet{InfoHashes: []InfoHash{ih}}, []string{bad, addr}); err != nil {
+		t.Error(err)
+	}
+
+	// Requests from the peer are rejected and stray rejects are ignored.
+	rejected := make(chan int64, 1)
+	probing := listenSeeder(t, info, rejected)
+	if _, err = FetchMetaInfo(ctx, Magnet{InfoHashes: []InfoHash{ih}}, []string{probing}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case piece := <-rejected:
+		if piece != 0 {
+			t.Errorf("Rejected piece %d, wanted 0", piece)
+		}
+	case <-ctx.Done():
+		t.Error("Request from the peer was not rejected")
+	}
+}
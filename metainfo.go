@@ -3,11 +3,14 @@ package taipei
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/jackpal/bencode-go"
@@ -40,6 +43,8 @@ type InfoDict struct {
 	Md5sum string
 	// Multiple File mode
 	Files []FileDict
+	// 2 for BitTorrent v2 and hybrid torrents (BEP 52).
+	MetaVersion int64 "meta version"
 }
 
 func (i InfoDict) String() string {
@@ -55,16 +60,49 @@ func (i InfoDict) String() string {
 
 type MetaInfo struct {
 	Info         InfoDict
-	InfoHash     string
+	InfoHash     InfoHash
+	InfoHashV2   InfoHashV2 // Zero unless this is a v2 torrent.
 	Announce     string
-	CreationDate string "creation date"
+	AnnounceList [][]string // Tiers of tracker URLs (BEP 12).
+	UrlList      []string   // Web seed URLs (BEP 19).
+	Nodes        []string   // DHT nodes of trackerless torrents as host:port (BEP 5).
+	CreationDate string     "creation date"
 	Comment      string
 	CreatedBy    string "created by"
 	Encoding     string
 }
 
 func (m MetaInfo) String() string {
-	return fmt.Sprintf("%v\n%X\t%s", m.Info, m.InfoHash, m.Encoding)
+	return fmt.Sprintf("%v\n%X\t%s", m.Info, m.InfoHash[:], m.Encoding)
+}
+
+// getNodes parses the "nodes" key, a list of [host, port] pairs.
+func getNodes(m map[string]interface{}) (r []string) {
+	nodes, _ := m["nodes"].([]interface{})
+	for _, n := range nodes {
+		pair, ok := n.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		host, _ := pair[0].(string)
+		port, _ := pair[1].(int64)
+		if host != "" && port > 0 && port <= 65535 {
+			r = append(r, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+		}
+	}
+	return
+}
+
+// Trackers returns the tiers of tracker URLs to announce to: the
+// announce-list if there is one, as BEP 12 asks, or else the announce URL.
+func (m *MetaInfo) Trackers() (tiers [][]string) {
+	for _, tier := range m.AnnounceList {
+		tiers = append(tiers, append([]string(nil), tier...))
+	}
+	if len(tiers) == 0 && m.Announce != "" {
+		tiers = [][]string{{m.Announce}}
+	}
+	return
 }
 
 func getString(m map[string]interface{}, k string) string {
@@ -76,60 +114,60 @@ func getString(m map[string]interface{}, k string) string {
 	return ""
 }
 
-func GetMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
-	var input io.ReadCloser
-	if input, err = os.Open(torrent); err != nil {
-		return
-	}
-
-	// We need to calcuate the sha1 of the Info map, including every value in the
-	// map. The easiest way to do this is to read the data using the Decode
-	// API, and then pick through it manually.
-	var m interface{}
-	m, err = bencode.Decode(input)
-	input.Close()
-	if err != nil {
-		err = errors.New("Couldn't parse torrent file phase 1: " + err.Error())
-		return
-	}
-
-	topMap, ok := m.(map[string]interface{})
-	if !ok {
-		err = errors.New("Couldn't parse torrent file phase 2.")
-		return
+func getStringList(m map[string]interface{}, k string) (r []string) {
+	switch v := m[k].(type) {
+	case string:
+		if v != "" {
+			r = []string{v}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s != "" {
+				r = append(r, s)
+			}
+		}
 	}
+	return
+}
 
-	infoMap, ok := topMap["info"]
+func getAnnounceList(m map[string]interface{}) (r [][]string) {
+	tiers, ok := m["announce-list"].([]interface{})
 	if !ok {
-		err = errors.New("Couldn't parse torrent file. info")
 		return
 	}
-	var b bytes.Buffer
-	if err = bencode.Marshal(&b, infoMap); err != nil {
-		return
+	for _, t := range tiers {
+		tier, ok := t.([]interface{})
+		if !ok {
+			continue
+		}
+		var urls []string
+		for _, u := range tier {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+		if len(urls) > 0 {
+			r = append(r, urls)
+		}
 	}
-	hash := sha1.New()
-	hash.Write(b.Bytes())
+	return
+}
 
-	var m2 MetaInfo
-	err = bencode.Unmarshal(&b, &m2.Info)
-	if err != nil {
+func GetMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
+	var input io.ReadCloser
+	if input, err = os.Open(torrent); err != nil {
 		return
 	}
-
-	m2.InfoHash = string(hash.Sum(nil))
-	m2.Announce = getString(topMap, "announce")
-	m2.CreationDate = getString(topMap, "creation date")
-	m2.Comment = getString(topMap, "comment")
-	m2.CreatedBy = getString(topMap, "created by")
-	m2.Encoding = getString(topMap, "encoding")
-
-	metaInfo = &m2
+	metaInfo, err = decodeMetaInfo(input)
+	input.Close()
 	return
 }
 
 func DecodeMetaInfo(p []byte) (metaInfo *MetaInfo, err error) {
-	input := bytes.NewReader(p)
+	return decodeMetaInfo(bytes.NewReader(p))
+}
+
+func decodeMetaInfo(input io.Reader) (metaInfo *MetaInfo, err error) {
 	// We need to calcuate the sha1 of the Info map, including every value in the
 	// map. The easiest way to do this is to read the data using the Decode
 	// API, and then pick through it manually.
@@ -155,17 +193,23 @@ func DecodeMetaInfo(p []byte) (metaInfo *MetaInfo, err error) {
 	if err = bencode.Marshal(&b, infoMap); err != nil {
 		return
 	}
-	hash := sha1.New()
-	hash.Write(b.Bytes())
+	hash := sha1.Sum(b.Bytes())
+	hashV2 := sha256.Sum256(b.Bytes())
 
 	var m2 MetaInfo
 	err = bencode.Unmarshal(&b, &m2.Info)
 	if err != nil {
 		return
 	}
+	if m2.Info.MetaVersion == 2 {
+		m2.InfoHashV2 = hashV2
+	}
 
-	m2.InfoHash = string(hash.Sum(nil))
+	m2.InfoHash = hash
 	m2.Announce = getString(topMap, "announce")
+	m2.AnnounceList = getAnnounceList(topMap)
+	m2.UrlList = getStringList(topMap, "url-list")
+	m2.Nodes = getNodes(topMap)
 	m2.CreationDate = getString(topMap, "creation date")
 	m2.Comment = getString(topMap, "comment")
 	m2.CreatedBy = getString(topMap, "created by")
@@ -31,9 +31,14 @@ func CheckPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int /*
 		if bytes.Compare([]byte(ref[base:end]), currentSums[base:end]) == 0 {
 			good++
 			// goodBits.Set(int(i))
+			if pc, ok := fs.(PieceCompleter); ok {
+				if err = pc.CompletePiece(i); err != nil {
+					return
+				}
+			}
 		} else {
 			if v, ok := fs.(*fileStore); ok {
-				fmt.Printf("[%d]: %s\n", i, v.files[v.find(int64(i)*pieceLength)].fd.Name())
+				fmt.Printf("[%d]: %s\n", i, v.files[v.find(int64(i)*pieceLength)].filename())
 			}
 			bad++
 		}
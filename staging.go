@@ -0,0 +1,66 @@
+package taipei
+
+import (
+	"fmt"
+	"os"
+)
+
+// PieceCompleter is implemented by FileStores that need to know when a piece
+// has passed its hash check. Stores opened with staging options rename a
+// file into place once every piece overlapping it has been completed.
+type PieceCompleter interface {
+	CompletePiece(index int) error
+}
+
+// CompletePiece records that piece index has been verified and moves every
+// file it completes to its final name. It is a no-op for stores without
+// staging.
+func (f *fileStore) CompletePiece(index int) (err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return errStoreClosed
+	}
+	f.verifyMu.Lock()
+	defer f.verifyMu.Unlock()
+	if f.verified == nil {
+		return
+	}
+	if index < 0 || index >= f.verified.n {
+		return fmt.Errorf("Piece index %d out of range.", index)
+	}
+	f.verified.Set(index)
+	start := int64(index) * f.pieceLength
+	end := start + f.pieceLength
+	for i := f.find(start); i < len(f.files) && f.offsets[i] < end; i++ {
+		entry := &f.files[i]
+		if entry.final == "" {
+			continue
+		}
+		first := int(f.offsets[i] / f.pieceLength)
+		last := int((f.offsets[i] + entry.length - 1) / f.pieceLength)
+		if next := f.verified.FindNextClear(first); next >= 0 && next <= last {
+			continue
+		}
+		if err = f.promote(entry); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// promote renames a staged file to its final name once in-flight I/O on it
+// has finished.
+func (f *fileStore) promote(entry *fileEntry) (err error) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	f.pool.forget(entry.name)
+	if err = ensureDirectory(entry.final); err != nil {
+		return
+	}
+	if err = os.Rename(entry.name, entry.final); err != nil {
+		return
+	}
+	entry.name, entry.final = entry.final, ""
+	return
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package taipei
+
+// freeSpace reports -1 where free space cannot be queried, which disables
+// the check.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,933 @@
+package taipei
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zyxar/taipei/wire"
+)
+
+// A download session: fetching the pieces of a torrent from peers into a
+// FileStore and serving the verified ones back, as defined by BEP 3.
+
+const (
+	// BlockSize is the length of the blocks requested from peers.
+	BlockSize = 16 * 1024
+	// MaxRequests is the number of block requests kept outstanding per
+	// peer.
+	MaxRequests = 16
+	// DefaultMaxPeers caps the connections of a Torrent when MaxPeers is
+	// zero.
+	DefaultMaxPeers = 50
+	// DefaultRequestTimeout is how long a peer may take to answer a block
+	// request before it is dropped.
+	DefaultRequestTimeout = time.Minute
+	// DefaultKeepAliveInterval is how often an otherwise quiet
+	// connection sends a keep-alive.
+	DefaultKeepAliveInterval = 2 * time.Minute
+	// DefaultIdleTimeout is how long a peer may send nothing, not even a
+	// keep-alive, before it is dropped.
+	DefaultIdleTimeout = 3 * time.Minute
+)
+
+// Timeouts of peer connections.
+var (
+	DialTimeout      = 10 * time.Second
+	HandshakeTimeout = 20 * time.Second
+	WriteTimeout     = 30 * time.Second
+)
+
+var (
+	ErrStopped        = errors.New("Torrent is stopped.")
+	ErrRunning        = errors.New("Torrent is already running.")
+	ErrRequestTimeout = errors.New("Peer did not answer a block request in time.")
+)
+
+// TorrentState is the state of a Torrent.
+type TorrentState int
+
+const (
+	Downloading TorrentState = iota
+	Seeding                  // Every piece has been verified.
+	Stopped
+)
+
+var stateNames = []string{"downloading", "seeding", "stopped"}
+
+func (s TorrentState) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("TorrentState(%d)", int(s))
+}
+
+// EventType tells what an Event reports.
+type EventType int
+
+const (
+	PeerConnected    EventType = iota
+	PeerDisconnected           // Also sent when a connection could not be made.
+	PieceCompleted
+	PieceFailed // The piece failed its hash check or could not be written.
+	StateChanged
+)
+
+// Event reports a change in a Torrent. Only the fields used by its Type are
+// meaningful.
+type Event struct {
+	Type  EventType
+	Peer  string       // PeerConnected, PeerDisconnected: address of the peer.
+	Piece int          // PieceCompleted, PieceFailed.
+	State TorrentState // StateChanged.
+	Err   error        // PeerDisconnected, PieceFailed.
+}
+
+// Progress is a snapshot of the transfer of a Torrent.
+type Progress struct {
+	State      TorrentState
+	Pieces     int   // Verified pieces.
+	NumPieces  int   // Pieces in the torrent.
+	Left       int64 // Bytes still to verify.
+	Downloaded int64 // Payload bytes received.
+	Uploaded   int64 // Payload bytes sent.
+	Peers      int   // Connected peers.
+}
+
+// PeerSource finds the peers of a torrent, for instance from trackers or
+// the DHT.
+type PeerSource interface {
+	// FindPeers calls found with peer addresses as host:port until ctx
+	// is done.
+	FindPeers(ctx context.Context, ih InfoHash, found func(addr string))
+}
+
+// StaticPeers is a PeerSource returning a fixed list of addresses.
+type StaticPeers []string
+
+func (s StaticPeers) FindPeers(ctx context.Context, ih InfoHash, found func(addr string)) {
+	for _, addr := range s {
+		found(addr)
+	}
+}
+
+// Torrent downloads the pieces of a torrent from peers into a FileStore and
+// uploads the pieces it has to peers. Pieces are requested in blocks of
+// BlockSize, verified against the piece hashes of the metainfo and then
+// written to the store; the store is told about them through
+// PieceCompleter when it implements it.
+type Torrent struct {
+	// OnEvent, when set, is called with every event. Calls are
+	// serialised; set it before calling Run or Serve.
+	OnEvent func(Event)
+	// MaxPeers caps the number of connections. Zero means
+	// DefaultMaxPeers.
+	MaxPeers int
+	// RequestTimeout, KeepAliveInterval and IdleTimeout tune peer
+	// connections; zero means the defaults above. A peer that leaves a
+	// request unanswered for RequestTimeout or sends nothing for
+	// IdleTimeout is dropped, and its blocks are requested from others.
+	RequestTimeout    time.Duration
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+
+	meta        *MetaInfo
+	store       FileStore
+	source      PeerSource
+	peerID      [20]byte
+	totalLength int64
+	numPieces   int
+	ctx         context.Context // Cancelled when the torrent stops.
+	cancel      context.CancelFunc
+	eventMu     sync.Mutex // Serialises OnEvent.
+	wg          sync.WaitGroup
+
+	mu         sync.Mutex
+	state      TorrentState
+	running    bool
+	have       *Bitset
+	pieces     map[int]*pieceBuf // Pieces being downloaded.
+	peers      map[*peer]bool
+	conns      map[net.Conn]bool
+	listeners  map[net.Listener]bool
+	dialing    map[string]bool
+	downloaded int64
+	uploaded   int64
+	done       chan struct{}
+}
+
+// NewTorrent creates a session for the torrent of m stored in store, which
+// must have the layout of m.Info, such as one from NewFileStore. The
+// content of the store is hashed first to find the pieces it already has.
+// source may be nil when peers are added with AddPeer or only come in
+// through Serve; without Run, the torrent is stopped with Close.
+func NewTorrent(m *MetaInfo, store FileStore, source PeerSource) (*Torrent, error) {
+	t := &Torrent{
+		meta:        m,
+		store:       store,
+		source:      source,
+		peerID:      NewPeerID(),
+		totalLength: m.Info.Length,
+		pieces:      make(map[int]*pieceBuf),
+		peers:       make(map[*peer]bool),
+		conns:       make(map[net.Conn]bool),
+		listeners:   make(map[net.Listener]bool),
+		dialing:     make(map[string]bool),
+		done:        make(chan struct{}),
+	}
+	for _, f := range m.Info.Files {
+		t.totalLength += f.Length
+	}
+	pieceLength := m.Info.PieceLength
+	if pieceLength <= 0 {
+		return nil, errors.New("Invalid piece length.")
+	}
+	t.numPieces = int((t.totalLength + pieceLength - 1) / pieceLength)
+	if t.numPieces == 0 {
+		return nil, errors.New("Torrent has no pieces.")
+	}
+	if len(m.Info.Pieces) != t.numPieces*sha1.Size {
+		return nil, errors.New("Incorrect Info.Pieces length")
+	}
+	t.have = NewBitset(t.numPieces)
+	sums, err := ComputeSums(store, t.totalLength, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < t.numPieces; i++ {
+		if string(sums[i*sha1.Size:(i+1)*sha1.Size]) != t.pieceHash(i) {
+			continue
+		}
+		t.have.Set(i)
+		if pc, ok := store.(PieceCompleter); ok {
+			if err = pc.CompletePiece(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if t.have.All() {
+		t.state = Seeding
+		close(t.done)
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t, nil
+}
+
+func (t *Torrent) pieceHash(index int) string {
+	return t.meta.Info.Pieces[index*sha1.Size : (index+1)*sha1.Size]
+}
+
+func (t *Torrent) pieceSize(index int) int {
+	pieceLength := t.meta.Info.PieceLength
+	if index == t.numPieces-1 {
+		return int(t.totalLength - int64(index)*pieceLength)
+	}
+	return int(pieceLength)
+}
+
+// PeerID returns the peer id the torrent handshakes with.
+func (t *Torrent) PeerID() [20]byte {
+	return t.peerID
+}
+
+// Have returns a copy of the set of verified pieces.
+func (t *Torrent) Have() *Bitset {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.have.Clone()
+}
+
+// Done returns a channel that is closed once every piece is verified.
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+// Progress returns the current state and totals of the torrent.
+func (t *Torrent) Progress() (p Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.State = t.state
+	p.NumPieces = t.numPieces
+	p.Left = t.totalLength
+	t.have.ForEach(func(i int) bool {
+		p.Pieces++
+		p.Left -= int64(t.pieceSize(i))
+		return true
+	})
+	p.Downloaded, p.Uploaded = t.downloaded, t.uploaded
+	p.Peers = len(t.peers)
+	return
+}
+
+func (t *Torrent) emit(e Event) {
+	if t.OnEvent == nil {
+		return
+	}
+	t.eventMu.Lock()
+	defer t.eventMu.Unlock()
+	t.OnEvent(e)
+}
+
+func (t *Torrent) maxPeers() int {
+	if t.MaxPeers > 0 {
+		return t.MaxPeers
+	}
+	return DefaultMaxPeers
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// Run connects to the peers found by the peer source until ctx is done,
+// then closes every connection and stops the torrent. If the torrent is
+// closed first, Run returns ErrStopped. A stopped torrent cannot be run
+// again.
+func (t *Torrent) Run(ctx context.Context) error {
+	t.mu.Lock()
+	if t.state == Stopped {
+		t.mu.Unlock()
+		return ErrStopped
+	}
+	if t.running {
+		t.mu.Unlock()
+		return ErrRunning
+	}
+	t.running = true
+	t.mu.Unlock()
+	if t.source != nil {
+		go t.source.FindPeers(ctx, t.meta.InfoHash, t.AddPeer)
+	}
+	select {
+	case <-ctx.Done():
+	case <-t.ctx.Done():
+		t.stop()
+		return ErrStopped
+	}
+	t.stop()
+	return ctx.Err()
+}
+
+// Close stops the torrent as the end of Run does: every connection and
+// listener is closed and Run and Serve return. Closing a stopped torrent
+// does nothing.
+func (t *Torrent) Close() error {
+	t.stop()
+	return nil
+}
+
+// stop stops the torrent and waits for its connections to finish. Only the
+// first call emits the Stopped event.
+func (t *Torrent) stop() {
+	t.mu.Lock()
+	if t.state == Stopped {
+		t.mu.Unlock()
+		t.wg.Wait()
+		return
+	}
+	t.state = Stopped
+	t.cancel()
+	for conn, _ := range t.conns {
+		conn.Close()
+	}
+	for l, _ := range t.listeners {
+		l.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	t.emit(Event{Type: StateChanged, State: Stopped})
+}
+
+// track runs f in a goroutine that stop waits for, unless the torrent is
+// already stopped.
+func (t *Torrent) track(f func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == Stopped {
+		return false
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// AddPeer connects to the peer at addr, unless it is already connected or
+// the torrent has MaxPeers connections.
+func (t *Torrent) AddPeer(addr string) {
+	t.mu.Lock()
+	full := len(t.peers)+len(t.dialing) >= t.maxPeers()
+	for p, _ := range t.peers {
+		if p.addr == addr {
+			full = true
+		}
+	}
+	if full || t.dialing[addr] {
+		t.mu.Unlock()
+		return
+	}
+	t.dialing[addr] = true
+	t.mu.Unlock()
+	started := t.track(func() {
+		err := t.dial(addr)
+		t.mu.Lock()
+		delete(t.dialing, addr)
+		t.mu.Unlock()
+		if err != nil {
+			t.emit(Event{Type: PeerDisconnected, Peer: addr, Err: err})
+		}
+	})
+	if !started {
+		t.mu.Lock()
+		delete(t.dialing, addr)
+		t.mu.Unlock()
+	}
+}
+
+func (t *Torrent) dial(addr string) error {
+	d := net.Dialer{Timeout: DialTimeout}
+	conn, err := d.DialContext(t.ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !t.addConn(conn) {
+		return ErrStopped
+	}
+	defer t.removeConn(conn)
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	h := wire.Handshake{InfoHash: t.meta.InfoHash, PeerID: t.peerID}
+	if err = wire.WriteHandshake(conn, &h); err != nil {
+		return err
+	}
+	ph, err := wire.ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	if err = t.checkHandshake(&ph); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	t.runPeer(conn, addr)
+	return nil
+}
+
+// Serve accepts incoming connections on l until l is closed or the torrent
+// stops, which closes l.
+func (t *Torrent) Serve(l net.Listener) error {
+	t.mu.Lock()
+	if t.state == Stopped {
+		t.mu.Unlock()
+		return ErrStopped
+	}
+	t.listeners[l] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.listeners, l)
+		t.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			t.mu.Lock()
+			if t.state == Stopped {
+				err = ErrStopped
+			}
+			t.mu.Unlock()
+			return err
+		}
+		if !t.track(func() { t.accept(conn) }) {
+			conn.Close()
+			return ErrStopped
+		}
+	}
+}
+
+func (t *Torrent) accept(conn net.Conn) {
+	if !t.addConn(conn) {
+		return
+	}
+	defer t.removeConn(conn)
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	ph, err := wire.ReadHandshake(conn)
+	if err != nil || t.checkHandshake(&ph) != nil {
+		return
+	}
+	h := wire.Handshake{InfoHash: t.meta.InfoHash, PeerID: t.peerID}
+	if err = wire.WriteHandshake(conn, &h); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t.runPeer(conn, conn.RemoteAddr().String())
+}
+
+func (t *Torrent) checkHandshake(ph *wire.Handshake) error {
+	if ph.InfoHash != t.meta.InfoHash {
+		return errors.New("Peer answered with a different info hash.")
+	}
+	if ph.PeerID == t.peerID {
+		return errors.New("Connected to ourselves.")
+	}
+	return nil
+}
+
+// addConn registers conn to be closed when the torrent stops; conn is
+// closed at once if it already has.
+func (t *Torrent) addConn(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == Stopped {
+		conn.Close()
+		return false
+	}
+	t.conns[conn] = true
+	return true
+}
+
+func (t *Torrent) removeConn(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+// block identifies a block by piece index and offset.
+type block struct {
+	index, begin int
+}
+
+// pieceBuf assembles the blocks of a piece being downloaded.
+type pieceBuf struct {
+	data      []byte
+	requested []bool
+	received  []bool
+	remaining int
+}
+
+func newPieceBuf(size int) *pieceBuf {
+	n := (size + BlockSize - 1) / BlockSize
+	return &pieceBuf{
+		data:      make([]byte, size),
+		requested: make([]bool, n),
+		received:  make([]bool, n),
+		remaining: n,
+	}
+}
+
+func (pb *pieceBuf) blockLen(k int) int {
+	if end := (k + 1) * BlockSize; end < len(pb.data) {
+		return BlockSize
+	}
+	return len(pb.data) - k*BlockSize
+}
+
+// next marks the first block that is neither requested nor received as
+// requested and returns its number.
+func (pb *pieceBuf) next() (int, bool) {
+	for k, _ := range pb.requested {
+		if !pb.requested[k] && !pb.received[k] {
+			pb.requested[k] = true
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// peer is a connection to a peer that completed the handshake.
+type peer struct {
+	addr      string
+	conn      net.Conn
+	wmu       sync.Mutex // Serialises writes and guards lastWrite.
+	w         *wire.Writer
+	lastWrite time.Time
+
+	// Guarded by Torrent.mu.
+	have       *Bitset
+	choked     bool                // The peer is choking us.
+	interested bool                // We are interested in the peer.
+	choking    bool                // We are choking the peer.
+	requests   map[block]time.Time // Outstanding requests by time sent.
+	err        error               // Why the peer was dropped.
+}
+
+func (p *peer) send(msgs ...*wire.Message) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	for _, m := range msgs {
+		if err := p.w.WriteMessage(m); err != nil {
+			return err
+		}
+	}
+	p.lastWrite = time.Now()
+	return nil
+}
+
+// keepAlive sends a keep-alive if nothing was sent for interval.
+func (p *peer) keepAlive(interval time.Duration) error {
+	p.wmu.Lock()
+	quiet := time.Since(p.lastWrite) >= interval
+	p.wmu.Unlock()
+	if !quiet {
+		return nil
+	}
+	return p.send(&wire.Message{KeepAlive: true})
+}
+
+// drop closes the connection to p, recording err as the reason.
+func (t *Torrent) drop(p *peer, err error) {
+	t.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	t.mu.Unlock()
+	p.conn.Close()
+}
+
+// watch drops p once a request is left unanswered for too long, and keeps
+// the connection alive, until done is closed.
+func (t *Torrent) watch(p *peer, done <-chan struct{}) {
+	timeout := orDefault(t.RequestTimeout, DefaultRequestTimeout)
+	interval := orDefault(t.KeepAliveInterval, DefaultKeepAliveInterval)
+	tick := timeout
+	if interval < tick {
+		tick = interval
+	}
+	ticker := time.NewTicker(tick / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			expired := false
+			t.mu.Lock()
+			for _, sent := range p.requests {
+				if now.Sub(sent) >= timeout {
+					expired = true
+				}
+			}
+			t.mu.Unlock()
+			if expired {
+				t.drop(p, ErrRequestTimeout)
+				return
+			}
+			if err := p.keepAlive(interval); err != nil {
+				t.drop(p, err)
+				return
+			}
+		}
+	}
+}
+
+func (t *Torrent) runPeer(conn net.Conn, addr string) {
+	p := &peer{
+		addr:      addr,
+		conn:      conn,
+		w:         wire.NewWriter(conn),
+		lastWrite: time.Now(),
+		have:      NewBitset(t.numPieces),
+		choked:    true,
+		choking:   true,
+		requests:  make(map[block]time.Time),
+	}
+	t.mu.Lock()
+	if len(t.peers) >= t.maxPeers() {
+		t.mu.Unlock()
+		return
+	}
+	t.peers[p] = true
+	var bitfield *wire.Message
+	if !t.have.None() {
+		bitfield = &wire.Message{Type: wire.Bitfield, Bitfield: append([]byte(nil), t.have.Bytes()...)}
+	}
+	t.mu.Unlock()
+	t.emit(Event{Type: PeerConnected, Peer: addr})
+
+	done, watched := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watched)
+		t.watch(p, done)
+	}()
+	err := t.readPeer(p, bitfield)
+	close(done)
+	<-watched
+
+	conn.Close()
+	t.mu.Lock()
+	delete(t.peers, p)
+	t.release(p)
+	if p.err != nil {
+		err = p.err
+	}
+	t.mu.Unlock()
+	t.emit(Event{Type: PeerDisconnected, Peer: addr, Err: err})
+	// Other peers may pick up the blocks that were requested from p.
+	t.updateAll()
+}
+
+func (t *Torrent) readPeer(p *peer, bitfield *wire.Message) error {
+	if bitfield != nil {
+		if err := p.send(bitfield); err != nil {
+			return err
+		}
+	}
+	r := wire.NewReader(p.conn)
+	r.NumPieces = t.numPieces
+	idle := orDefault(t.IdleTimeout, DefaultIdleTimeout)
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(idle))
+		m, err := r.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if m.KeepAlive {
+			continue
+		}
+		if err = t.handle(p, m); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *Torrent) handle(p *peer, m *wire.Message) error {
+	switch m.Type {
+	case wire.Choke:
+		t.mu.Lock()
+		p.choked = true
+		// Choking discards the requests of the peer.
+		t.release(p)
+		t.mu.Unlock()
+		t.updateAll()
+		return nil
+	case wire.Unchoke:
+		t.mu.Lock()
+		p.choked = false
+		t.mu.Unlock()
+	case wire.Interested:
+		t.mu.Lock()
+		unchoke := p.choking
+		p.choking = false
+		t.mu.Unlock()
+		if unchoke {
+			return p.send(&wire.Message{Type: wire.Unchoke})
+		}
+		return nil
+	case wire.NotInterested:
+		return nil
+	case wire.Have:
+		t.mu.Lock()
+		p.have.Set(int(m.Index))
+		t.mu.Unlock()
+	case wire.Bitfield:
+		t.mu.Lock()
+		p.have = NewBitsetFromBytes(t.numPieces, m.Bitfield)
+		t.mu.Unlock()
+	case wire.Request:
+		return t.upload(p, m)
+	case wire.Piece:
+		if err := t.receive(p, m); err != nil {
+			return err
+		}
+	default:
+		// Cancel needs nothing as requests are answered at once, and
+		// other messages are not negotiated.
+		return nil
+	}
+	return t.update(p)
+}
+
+// update sends the messages that follow from a change in the pieces p or
+// we have: a change of interest and new requests.
+func (t *Torrent) update(p *peer) error {
+	var msgs []*wire.Message
+	t.mu.Lock()
+	wants := p.have.Clone()
+	wants.AndNot(t.have)
+	if interested := !wants.None(); interested != p.interested {
+		p.interested = interested
+		if interested {
+			msgs = append(msgs, &wire.Message{Type: wire.Interested})
+		} else {
+			msgs = append(msgs, &wire.Message{Type: wire.NotInterested})
+		}
+	}
+	if p.interested && !p.choked {
+		for len(p.requests) < MaxRequests {
+			b, ok := t.pick(p)
+			if !ok {
+				break
+			}
+			p.requests[b] = time.Now()
+			length := t.pieces[b.index].blockLen(b.begin / BlockSize)
+			msgs = append(msgs, &wire.Message{Type: wire.Request, Index: uint32(b.index), Begin: uint32(b.begin), Length: uint32(length)})
+		}
+	}
+	t.mu.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	return p.send(msgs...)
+}
+
+func (t *Torrent) updateAll() {
+	t.mu.Lock()
+	peers := make([]*peer, 0, len(t.peers))
+	for p, _ := range t.peers {
+		peers = append(peers, p)
+	}
+	t.mu.Unlock()
+	for _, p := range peers {
+		if err := t.update(p); err != nil {
+			p.conn.Close()
+		}
+	}
+}
+
+// pick chooses the next block to request from p, preferring pieces that are
+// already under way. It must be called with t.mu held.
+func (t *Torrent) pick(p *peer) (b block, ok bool) {
+	for index, pb := range t.pieces {
+		if !p.have.IsSet(index) {
+			continue
+		}
+		if k, ok := pb.next(); ok {
+			return block{index, k * BlockSize}, true
+		}
+	}
+	// Start a new piece, from a random place so that peers spread out.
+	start := rand.Intn(t.numPieces)
+	for i := 0; i < t.numPieces; i++ {
+		index := (start + i) % t.numPieces
+		if t.have.IsSet(index) || !p.have.IsSet(index) || t.pieces[index] != nil {
+			continue
+		}
+		pb := newPieceBuf(t.pieceSize(index))
+		t.pieces[index] = pb
+		k, _ := pb.next()
+		return block{index, k * BlockSize}, true
+	}
+	return
+}
+
+// release forgets the outstanding requests of p so that the blocks can be
+// requested again. It must be called with t.mu held.
+func (t *Torrent) release(p *peer) {
+	for b, _ := range p.requests {
+		if pb := t.pieces[b.index]; pb != nil {
+			pb.requested[b.begin/BlockSize] = false
+		}
+	}
+	p.requests = make(map[block]time.Time)
+}
+
+// upload answers a request of p for a block of a verified piece.
+func (t *Torrent) upload(p *peer, m *wire.Message) error {
+	index, begin, length := int(m.Index), int64(m.Begin), int64(m.Length)
+	t.mu.Lock()
+	ok := !p.choking && t.have.IsSet(index) && begin+length <= int64(t.pieceSize(index))
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	data := make([]byte, length)
+	if _, err := t.store.ReadAt(data, int64(index)*t.meta.Info.PieceLength+begin); err != nil {
+		return err
+	}
+	if err := p.send(&wire.Message{Type: wire.Piece, Index: m.Index, Begin: m.Begin, Block: data}); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.uploaded += length
+	t.mu.Unlock()
+	return nil
+}
+
+// receive stores a block sent by p and completes its piece once every block
+// has arrived.
+func (t *Torrent) receive(p *peer, m *wire.Message) error {
+	b := block{int(m.Index), int(m.Begin)}
+	t.mu.Lock()
+	pb := t.pieces[b.index]
+	if _, ok := p.requests[b]; !ok || pb == nil {
+		// Not requested, or requested before a choke.
+		t.mu.Unlock()
+		return nil
+	}
+	delete(p.requests, b)
+	k := b.begin / BlockSize
+	if len(m.Block) != pb.blockLen(k) {
+		pb.requested[k] = false
+		t.mu.Unlock()
+		return fmt.Errorf("Peer sent %d bytes for block %d+%d.", len(m.Block), b.index, b.begin)
+	}
+	if pb.received[k] {
+		t.mu.Unlock()
+		return nil
+	}
+	copy(pb.data[b.begin:], m.Block)
+	pb.received[k] = true
+	pb.remaining--
+	t.downloaded += int64(len(m.Block))
+	complete := pb.remaining == 0
+	t.mu.Unlock()
+	if complete {
+		t.completePiece(b.index, pb.data)
+	}
+	return nil
+}
+
+// completePiece verifies and writes a downloaded piece. A piece that fails
+// is downloaded again.
+func (t *Torrent) completePiece(index int, data []byte) {
+	var err error
+	if sum := sha1.Sum(data); string(sum[:]) != t.pieceHash(index) {
+		err = fmt.Errorf("Piece %d failed the hash check.", index)
+	} else if _, err = t.store.WriteAt(data, int64(index)*t.meta.Info.PieceLength); err == nil {
+		if pc, ok := t.store.(PieceCompleter); ok {
+			err = pc.CompletePiece(index)
+		}
+	}
+	t.mu.Lock()
+	delete(t.pieces, index)
+	seeding := false
+	var peers []*peer
+	if err == nil {
+		t.have.Set(index)
+		if t.have.All() && t.state == Downloading {
+			t.state = Seeding
+			seeding = true
+			close(t.done)
+		}
+		for p, _ := range t.peers {
+			peers = append(peers, p)
+		}
+	}
+	t.mu.Unlock()
+	if err != nil {
+		t.emit(Event{Type: PieceFailed, Piece: index, Err: err})
+		t.updateAll()
+		return
+	}
+	have := &wire.Message{Type: wire.Have, Index: uint32(index)}
+	for _, p := range peers {
+		if p.send(have) != nil {
+			p.conn.Close()
+		}
+	}
+	t.emit(Event{Type: PieceCompleted, Piece: index})
+	if seeding {
+		t.emit(Event{Type: StateChanged, State: Seeding})
+	}
+	t.updateAll()
+}
@@ -0,0 +1,390 @@
+package taipei
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyxar/taipei/wire"
+)
+
+// testTorrent returns the metainfo of two files holding data, with pieces
+// that are not a multiple of BlockSize.
+func testTorrent(data []byte, pieceLength int64) *MetaInfo {
+	m := &MetaInfo{Info: InfoDict{Name: "session", PieceLength: pieceLength, Files: []FileDict{
+		{Length: int64(len(data)) / 3, Path: []string{"a"}},
+		{Length: int64(len(data)) - int64(len(data))/3, Path: []string{"b"}},
+	}}}
+	var pieces bytes.Buffer
+	for off := int64(0); off < int64(len(data)); off += pieceLength {
+		end := off + pieceLength
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sum := sha1.Sum(data[off:end])
+		pieces.Write(sum[:])
+	}
+	m.Info.Pieces = pieces.String()
+	m.InfoHash = InfoHash(sha1.Sum([]byte("session")))
+	return m
+}
+
+// seed starts a session over a memory store holding the pieces of data
+// selected by keep, and returns its listen address.
+func seed(t *testing.T, ctx context.Context, m *MetaInfo, data []byte, keep func(index int) bool) string {
+	store, _, err := NewMemFileStore(&m.Info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieceLength := int(m.Info.PieceLength)
+	for off := 0; off < len(data); off += pieceLength {
+		end := off + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		if keep(off / pieceLength) {
+			store.WriteAt(data[off:end], int64(off))
+		}
+	}
+	s, err := NewTorrent(m, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	go s.Run(ctx)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestTorrentDownload(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(data)
+	m := testTorrent(data, 40000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	// Each seeder has half of the pieces.
+	even := seed(t, ctx, m, data, func(i int) bool { return i%2 == 0 })
+	odd := seed(t, ctx, m, data, func(i int) bool { return i%2 == 1 })
+
+	store, _, err := NewMemFileStore(&m.Info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewTorrent(m, store, StaticPeers{even, odd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := d.Progress(); p.State != Downloading || p.Pieces != 0 || p.NumPieces != 8 || p.Left != int64(len(data)) {
+		t.Fatalf("Initial progress %+v", p)
+	}
+	var mu sync.Mutex
+	var completed []int
+	var states []TorrentState
+	d.OnEvent = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch e.Type {
+		case PieceCompleted:
+			completed = append(completed, e.Piece)
+		case PieceFailed:
+			t.Errorf("Piece %d failed: %v", e.Piece, e.Err)
+		case StateChanged:
+			states = append(states, e.State)
+		}
+	}
+	dctx, dcancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() { stopped <- d.Run(dctx) }()
+	select {
+	case <-d.Done():
+	case <-ctx.Done():
+		t.Fatalf("Download did not finish: %+v", d.Progress())
+	}
+	got := make([]byte, len(data))
+	if _, err = store.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded data differs")
+	}
+	p := d.Progress()
+	if p.State != Seeding || p.Pieces != 8 || p.Left != 0 || p.Downloaded < int64(len(data)) {
+		t.Errorf("Final progress %+v", p)
+	}
+	dcancel()
+	if err = <-stopped; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+	mu.Lock()
+	if len(completed) != 8 {
+		t.Errorf("Completed pieces %v", completed)
+	}
+	if len(states) != 2 || states[0] != Seeding || states[1] != Stopped {
+		t.Errorf("States %v", states)
+	}
+	mu.Unlock()
+	if d.Run(ctx) != ErrStopped {
+		t.Error("Stopped torrent ran again")
+	}
+}
+
+func TestTorrentServe(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(data)
+	m := testTorrent(data, 32768)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	addr := seed(t, ctx, m, data, func(int) bool { return true })
+
+	// A complete store starts seeding.
+	store, _, _ := NewMemFileStore(&m.Info, 0)
+	store.WriteAt(data, 0)
+	s, err := NewTorrent(m, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Complete torrent is not done")
+	}
+
+	// Seeders connecting to each other exchange nothing.
+	s.AddPeer(addr)
+	sctx, scancel := context.WithCancel(ctx)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	ran := make(chan error, 1)
+	go func() { ran <- s.Run(sctx) }()
+	for s.Progress().Peers == 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = s.Run(sctx); err != ErrRunning {
+		t.Errorf("Second Run returned %v", err)
+	}
+	scancel()
+	<-ran
+	if p := s.Progress(); p.State != Stopped || p.Downloaded != 0 || p.Peers != 0 {
+		t.Errorf("Progress %+v", p)
+	}
+	// Stopping unblocks Serve.
+	select {
+	case err = <-served:
+		if err != ErrStopped {
+			t.Errorf("Serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Serve did not return after the torrent stopped")
+	}
+
+	// A torrent with a different info hash is refused.
+	other := testTorrent(data, 32768)
+	other.InfoHash[0] ^= 1
+	store, _, _ = NewMemFileStore(&other.Info, 0)
+	d, err := NewTorrent(other, store, StaticPeers{addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	d.OnEvent = func(e Event) {
+		if e.Type == PeerDisconnected {
+			select {
+			case errs <- e.Err:
+			default:
+			}
+		}
+	}
+	go d.Run(ctx)
+	select {
+	case err = <-errs:
+		if err == nil {
+			t.Error("Connected to a peer of another torrent")
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out")
+	}
+}
+
+func TestTorrentClose(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(4)).Read(data)
+	m := testTorrent(data, 32768)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// A torrent fed only through Serve is stopped with Close.
+	store, _, _ := NewMemFileStore(&m.Info, 0)
+	s, err := NewTorrent(m, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stops int
+	var mu sync.Mutex
+	s.OnEvent = func(e Event) {
+		if e.Type == StateChanged && e.State == Stopped {
+			mu.Lock()
+			stops++
+			mu.Unlock()
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	seeder := seed(t, ctx, m, data, func(int) bool { return true })
+	s.AddPeer(seeder)
+	for s.Progress().Peers == 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- s.Run(ctx) }()
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+	s.Close()
+	for _, ch := range []chan error{served, ran} {
+		select {
+		case err = <-ch:
+			if err != ErrStopped {
+				t.Errorf("Got %v after Close", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("Close did not stop the torrent")
+		}
+	}
+	if p := s.Progress(); p.State != Stopped || p.Peers != 0 {
+		t.Errorf("Progress %+v", p)
+	}
+	mu.Lock()
+	if stops != 1 {
+		t.Errorf("Stopped %d times", stops)
+	}
+	mu.Unlock()
+
+	// A torrent without pieces is refused.
+	empty := &MetaInfo{Info: InfoDict{Name: "empty", PieceLength: 32768}}
+	store, _, _ = NewMemFileStore(&empty.Info, 0)
+	if _, err = NewTorrent(empty, store, nil); err == nil {
+		t.Error("Created a torrent without pieces")
+	}
+}
+
+// silentPeer accepts one connection, claims every piece, unchokes and then
+// reads requests without ever answering them. It reports the first request
+// and the first keep-alive it reads.
+func silentPeer(t *testing.T, m *MetaInfo, requested, keptAlive chan<- struct{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, err := wire.ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		h.PeerID = NewPeerID()
+		w := wire.NewWriter(conn)
+		numPieces := len(m.Info.Pieces) / sha1.Size
+		bitfield := NewBitset(numPieces)
+		bitfield.Not()
+		if wire.WriteHandshake(conn, &h) != nil ||
+			w.WriteMessage(&wire.Message{Type: wire.Bitfield, Bitfield: bitfield.Bytes()}) != nil ||
+			w.WriteMessage(&wire.Message{Type: wire.Unchoke}) != nil {
+			return
+		}
+		r := wire.NewReader(conn)
+		r.NumPieces = numPieces
+		for {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg.KeepAlive && keptAlive != nil {
+				close(keptAlive)
+				keptAlive = nil
+			}
+			if msg.Type == wire.Request && requested != nil {
+				close(requested)
+				requested = nil
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTorrentRequestTimeout(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(3)).Read(data)
+	m := testTorrent(data, 40000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	requested, keptAlive := make(chan struct{}), make(chan struct{})
+	silent := silentPeer(t, m, requested, keptAlive)
+	addr := seed(t, ctx, m, data, func(int) bool { return true })
+
+	store, _, _ := NewMemFileStore(&m.Info, 0)
+	d, err := NewTorrent(m, store, StaticPeers{silent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.RequestTimeout = 300 * time.Millisecond
+	d.KeepAliveInterval = 50 * time.Millisecond
+	timedOut := make(chan struct{})
+	d.OnEvent = func(e Event) {
+		if e.Type == PeerDisconnected && e.Peer == silent && e.Err == ErrRequestTimeout {
+			close(timedOut)
+		}
+	}
+	go d.Run(ctx)
+	select {
+	case <-requested:
+	case <-ctx.Done():
+		t.Fatal("Silent peer got no request")
+	}
+	select {
+	case <-keptAlive:
+	case <-ctx.Done():
+		t.Fatal("Silent peer got no keep-alive")
+	}
+	// The blocks held by the silent peer are fetched from the seeder once
+	// their requests time out.
+	d.AddPeer(addr)
+	select {
+	case <-d.Done():
+	case <-ctx.Done():
+		t.Fatalf("Download did not finish: %+v", d.Progress())
+	}
+	select {
+	case <-timedOut:
+	case <-ctx.Done():
+		t.Fatal("Silent peer was not dropped")
+	}
+	got := make([]byte, len(data))
+	store.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded data differs")
+	}
+}
@@ -0,0 +1,248 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// MaxResponseSize bounds the size of tracker responses we read.
+const MaxResponseSize = 1 << 20
+
+var (
+	ErrScrapeUnsupported = errors.New("Tracker does not support scrape.")
+	ErrAnnounceTooSoon   = errors.New("Announce sent before the tracker's min interval.")
+)
+
+// HTTPClient announces to an HTTP or HTTPS tracker.
+type HTTPClient struct {
+	URL        string
+	HTTPClient *http.Client // http.DefaultClient if nil.
+	UserAgent  string
+
+	mu        sync.Mutex
+	trackerID string
+	next      time.Time // Earliest time for a regular announce.
+	now       func() time.Time
+}
+
+func NewHTTPClient(announceURL string) *HTTPClient {
+	return &HTTPClient{URL: announceURL}
+}
+
+func (c *HTTPClient) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Announce sends req to the tracker. A tracker id received earlier is sent
+// along unless req has its own. Announces without an event fail with
+// ErrAnnounceTooSoon if the tracker's min interval has not yet elapsed.
+func (c *HTTPClient) Announce(ctx context.Context, req *AnnounceRequest) (resp *AnnounceResponse, err error) {
+	c.mu.Lock()
+	trackerID, next := c.trackerID, c.next
+	c.mu.Unlock()
+	if req.Event == None && c.clock().Before(next) {
+		return nil, ErrAnnounceTooSoon
+	}
+	if req.TrackerID != "" {
+		trackerID = req.TrackerID
+	}
+	v := url.Values{}
+	v.Set("info_hash", string(req.InfoHash[:]))
+	v.Set("peer_id", string(req.PeerID[:]))
+	v.Set("port", strconv.Itoa(int(req.Port)))
+	v.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	v.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	v.Set("left", strconv.FormatInt(req.Left, 10))
+	v.Set("compact", "1")
+	if req.Event != None {
+		v.Set("event", req.Event.String())
+	}
+	if req.NumWant != 0 {
+		v.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != 0 {
+		v.Set("key", fmt.Sprintf("%08x", req.Key))
+	}
+	if trackerID != "" {
+		v.Set("trackerid", trackerID)
+	}
+	if req.IP != nil {
+		v.Set("ip", req.IP.String())
+	}
+	d, err := c.get(ctx, c.URL, v.Encode())
+	if err != nil {
+		return
+	}
+	if resp, err = parseAnnounce(d); err != nil {
+		return
+	}
+	c.mu.Lock()
+	if resp.TrackerID != "" {
+		c.trackerID = resp.TrackerID
+	}
+	c.next = c.clock().Add(resp.MinInterval)
+	c.mu.Unlock()
+	return
+}
+
+// Scrape fetches statistics for the given torrents from the tracker's
+// scrape URL, derived from the announce URL by convention.
+func (c *HTTPClient) Scrape(ctx context.Context, infoHashes ...[20]byte) (r map[[20]byte]ScrapeResult, err error) {
+	scrapeURL, err := ScrapeURL(c.URL)
+	if err != nil {
+		return
+	}
+	v := url.Values{}
+	for _, ih := range infoHashes {
+		v.Add("info_hash", string(ih[:]))
+	}
+	d, err := c.get(ctx, scrapeURL, v.Encode())
+	if err != nil {
+		return
+	}
+	files, ok := d["files"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Scrape response has no files.")
+	}
+	r = make(map[[20]byte]ScrapeResult, len(files))
+	for k, fv := range files {
+		f, ok := fv.(map[string]interface{})
+		if len(k) != 20 || !ok {
+			continue
+		}
+		var ih [20]byte
+		copy(ih[:], k)
+		r[ih] = ScrapeResult{
+			Complete:   getInt(f, "complete"),
+			Downloaded: getInt(f, "downloaded"),
+			Incomplete: getInt(f, "incomplete"),
+		}
+	}
+	return
+}
+
+// ScrapeURL returns the scrape URL of an HTTP tracker: the last path
+// element must start with "announce", which is replaced by "scrape" (see
+// BEP 48).
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	return u.String(), nil
+}
+
+// get requests rawURL with the query appended to any it already has, such
+// as a passkey, and decodes the bencoded response.
+func (c *HTTPClient) get(ctx context.Context, rawURL, query string) (d map[string]interface{}, err error) {
+	if strings.Contains(rawURL, "?") {
+		rawURL += "&" + query
+	} else {
+		rawURL += "?" + query
+	}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxResponseSize))
+	if err != nil {
+		return
+	}
+	v, derr := bencode.Decode(bytes.NewReader(body))
+	d, ok := v.(map[string]interface{})
+	if derr == nil && ok {
+		// Trackers may send a failure reason with any status.
+		if reason, ok := d["failure reason"].(string); ok {
+			return nil, &FailureError{reason}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker returned %s.", resp.Status)
+	}
+	if derr != nil {
+		return nil, fmt.Errorf("Malformed tracker response: %v", derr)
+	}
+	if !ok {
+		return nil, errors.New("Tracker response is not a dictionary.")
+	}
+	return
+}
+
+func parseAnnounce(d map[string]interface{}) (r *AnnounceResponse, err error) {
+	r = &AnnounceResponse{
+		Interval:    time.Duration(getInt(d, "interval")) * time.Second,
+		MinInterval: time.Duration(getInt(d, "min interval")) * time.Second,
+		Complete:    getInt(d, "complete"),
+		Incomplete:  getInt(d, "incomplete"),
+	}
+	r.TrackerID, _ = d["tracker id"].(string)
+	r.Warning, _ = d["warning message"].(string)
+	switch peers := d["peers"].(type) {
+	case string:
+		if r.Peers, err = parseCompactPeers([]byte(peers), net.IPv4len); err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		for _, pv := range peers {
+			p, ok := pv.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ipStr, _ := p["ip"].(string)
+			ip := net.ParseIP(ipStr)
+			port := getInt(p, "port")
+			if ip == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			id, _ := p["peer id"].(string)
+			r.Peers = append(r.Peers, Peer{IP: ip, Port: uint16(port), ID: id})
+		}
+	}
+	if peers6, ok := d["peers6"].(string); ok {
+		p6, err := parseCompactPeers([]byte(peers6), net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		r.Peers = append(r.Peers, p6...)
+	}
+	return
+}
+
+func getInt(d map[string]interface{}, k string) int {
+	n, _ := d[k].(int64)
+	return int(n)
+}
@@ -0,0 +1,152 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testRequest() *AnnounceRequest {
+	req := &AnnounceRequest{Port: 6881, Left: 1000, Uploaded: 5, Downloaded: 7, Event: Started, NumWant: 30, Key: 0xdeadbeef}
+	copy(req.InfoHash[:], "\x01\x02\x03 &?=%+xxxxxxxxxxxxx")
+	copy(req.PeerID[:], "-TT0100-abcdefghijkl")
+	return req
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	req := testRequest()
+	var query map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		if r.URL.Path != "/announce" {
+			t.Errorf("Path %q", r.URL.Path)
+		}
+		if query["trackerid"] == nil {
+			w.Write([]byte("d8:completei3e10:incompletei4e8:intervali1800e12:min intervali60e" +
+				"5:peers12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2" +
+				"6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe3" +
+				"10:tracker id3:abc15:warning message4:slowe"))
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peersld2:ip8:10.0.0.77:peer id20:-XX0001-abcdefghijkl4:porti6889eeee"))
+	}))
+	defer srv.Close()
+
+	c := NewHTTPClient(srv.URL + "/announce?passkey=secret")
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	resp, err := c.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"info_hash": string(req.InfoHash[:]), "peer_id": string(req.PeerID[:]),
+		"port": "6881", "uploaded": "5", "downloaded": "7", "left": "1000",
+		"event": "started", "compact": "1", "numwant": "30", "key": "deadbeef", "passkey": "secret",
+	}
+	for k, v := range want {
+		if got := query[k]; len(got) != 1 || got[0] != v {
+			t.Errorf("%s = %q, wanted %q", k, got, v)
+		}
+	}
+	wantResp := &AnnounceResponse{
+		Interval: 30 * time.Minute, MinInterval: time.Minute, TrackerID: "abc", Warning: "slow",
+		Complete: 3, Incomplete: 4,
+		Peers: []Peer{
+			{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+			{IP: net.IP{10, 0, 0, 2}, Port: 6882},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6883},
+		},
+	}
+	if !reflect.DeepEqual(resp, wantResp) {
+		t.Errorf("Got %+v, wanted %+v", resp, wantResp)
+	}
+
+	// Regular announces wait for the min interval; the tracker id is
+	// sent back.
+	req.Event = None
+	if _, err = c.Announce(context.Background(), req); err != ErrAnnounceTooSoon {
+		t.Errorf("Wanted ErrAnnounceTooSoon, got %v", err)
+	}
+	now = now.Add(time.Minute)
+	if resp, err = c.Announce(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if query["trackerid"][0] != "abc" || query["event"] != nil {
+		t.Errorf("Got query %v", query)
+	}
+	wantPeer := Peer{IP: net.ParseIP("10.0.0.7"), Port: 6889, ID: "-XX0001-abcdefghijkl"}
+	if len(resp.Peers) != 1 || !reflect.DeepEqual(resp.Peers[0], wantPeer) {
+		t.Errorf("Got peers %v", resp.Peers)
+	}
+}
+
+func TestHTTPFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/announce":
+			w.Write([]byte("d14:failure reason12:unregisterede"))
+		case "/bad/announce":
+			w.Write([]byte("d5:peers5:abcdee"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	_, err := NewHTTPClient(srv.URL+"/announce").Announce(ctx, testRequest())
+	if fe, ok := err.(*FailureError); !ok || fe.Reason != "unregistered" {
+		t.Errorf("Wanted failure, got %v", err)
+	}
+	if _, err = NewHTTPClient(srv.URL+"/bad/announce").Announce(ctx, testRequest()); err == nil {
+		t.Error("Odd compact peer list accepted")
+	}
+	if _, err = NewHTTPClient(srv.URL+"/missing").Announce(ctx, testRequest()); err == nil {
+		t.Error("404 accepted")
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	var a, b [20]byte
+	copy(a[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(b[:], "bbbbbbbbbbbbbbbbbbbb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/x/scrape.php" || len(r.URL.Query()["info_hash"]) != 2 {
+			t.Errorf("Got request %v", r.URL)
+		}
+		w.Write([]byte("d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi2e10:incompletei3ee" +
+			"20:bbbbbbbbbbbbbbbbbbbbd8:completei4e10:downloadedi5e10:incompletei6eeee"))
+	}))
+	defer srv.Close()
+	r, err := NewHTTPClient(srv.URL+"/x/announce.php").Scrape(context.Background(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[20]byte]ScrapeResult{a: {1, 2, 3}, b: {4, 5, 6}}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Got %v, wanted %v", r, want)
+	}
+	if _, err = NewHTTPClient(srv.URL+"/x/a").Scrape(context.Background(), a); err != ErrScrapeUnsupported {
+		t.Errorf("Wanted ErrScrapeUnsupported, got %v", err)
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce?k=v", "http://example.com/x/scrape?k=v"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+	}
+	for _, test := range tests {
+		got, err := ScrapeURL(test.in)
+		if got != test.out || (err != nil) != (test.out == "") {
+			t.Errorf("ScrapeURL(%q) = %q, %v", test.in, got, err)
+		}
+	}
+}
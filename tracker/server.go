@@ -0,0 +1,224 @@
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Announce intervals handed out by Server unless configured otherwise.
+const (
+	DefaultInterval    = 30 * time.Minute
+	DefaultMinInterval = time.Minute
+)
+
+// Store keeps the swarms of a tracker. Swarms is the in-memory
+// implementation; other backends may share swarms between processes. A
+// Store can serve several tracker front ends at once.
+type Store interface {
+	// Announce records the announcing peer and returns peers for it.
+	Announce(req *AnnounceRequest, addr net.IP) ([]Peer, ScrapeResult, error)
+	Scrape(infoHash [20]byte, addr net.IP) (ScrapeResult, error)
+	// Public returns the torrents listed in a full scrape.
+	Public() [][20]byte
+}
+
+// Server is an http.Handler serving announce and scrape requests for the
+// torrents in Store. Requests are routed on the last path element, which
+// must be "announce" or "scrape".
+type Server struct {
+	Store       Store
+	Interval    time.Duration // Zero means DefaultInterval.
+	MinInterval time.Duration // Zero means DefaultMinInterval.
+}
+
+func NewServer(store Store) *Server {
+	return &Server{Store: store}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addr := normalizeIP(net.ParseIP(host))
+	if addr == nil {
+		http.Error(w, "Invalid remote address.", http.StatusBadRequest)
+		return
+	}
+	var d map[string]interface{}
+	switch r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:] {
+	case "announce":
+		d, err = s.announce(r.URL.Query(), addr)
+	case "scrape":
+		d, err = s.scrape(r.URL.Query(), addr)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		d = map[string]interface{}{"failure reason": err.Error()}
+	}
+	var buf bytes.Buffer
+	if err = bencode.Marshal(&buf, d); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// normalizeIP returns IPv4 addresses, including IPv4-mapped IPv6 ones, in
+// their 4 byte form.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func hashParam(q url.Values, name string) (ih [20]byte, err error) {
+	v := q.Get(name)
+	if len(v) != len(ih) {
+		err = errors.New("Invalid " + name + ".")
+		return
+	}
+	copy(ih[:], v)
+	return
+}
+
+func intParam(q url.Values, name string, required bool) (n int64, err error) {
+	v := q.Get(name)
+	if v == "" && !required {
+		return
+	}
+	if n, err = strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+		err = errors.New("Invalid " + name + ".")
+	}
+	return
+}
+
+func (s *Server) announce(q url.Values, addr net.IP) (d map[string]interface{}, err error) {
+	req := new(AnnounceRequest)
+	if req.InfoHash, err = hashParam(q, "info_hash"); err != nil {
+		return
+	}
+	if req.PeerID, err = hashParam(q, "peer_id"); err != nil {
+		return
+	}
+	port, err := intParam(q, "port", true)
+	if err != nil || port == 0 || port > 65535 {
+		return nil, errors.New("Invalid port.")
+	}
+	req.Port = uint16(port)
+	if req.Uploaded, err = intParam(q, "uploaded", false); err != nil {
+		return
+	}
+	if req.Downloaded, err = intParam(q, "downloaded", false); err != nil {
+		return
+	}
+	if req.Left, err = intParam(q, "left", true); err != nil {
+		return
+	}
+	numWant, err := intParam(q, "numwant", false)
+	if err != nil {
+		return
+	}
+	req.NumWant = int(numWant)
+	switch q.Get("event") {
+	case "", "empty":
+	case "started":
+		req.Event = Started
+	case "completed":
+		req.Event = Completed
+	case "stopped":
+		req.Event = Stopped
+	default:
+		return nil, errors.New("Invalid event.")
+	}
+	peers, stats, err := s.Store.Announce(req, addr)
+	if err != nil {
+		return
+	}
+	d = map[string]interface{}{
+		"interval":     int(s.interval() / time.Second),
+		"min interval": int(s.minInterval() / time.Second),
+		"complete":     stats.Complete,
+		"incomplete":   stats.Incomplete,
+	}
+	if q.Get("compact") == "0" {
+		noPeerID := q.Get("no_peer_id") == "1"
+		list := make([]interface{}, 0, len(peers))
+		for _, p := range peers {
+			e := map[string]interface{}{"ip": p.IP.String(), "port": int(p.Port)}
+			if !noPeerID {
+				e["peer id"] = p.ID
+			}
+			list = append(list, e)
+		}
+		d["peers"] = list
+		return
+	}
+	var v4, v6 []byte
+	for _, p := range peers {
+		v4 = appendCompactPeer(v4, p, net.IPv4len)
+		v6 = appendCompactPeer(v6, p, net.IPv6len)
+	}
+	d["peers"] = string(v4)
+	if len(v6) > 0 {
+		d["peers6"] = string(v6)
+	}
+	return
+}
+
+// scrape answers for the requested torrents, or for every public torrent
+// if none is given. Unknown and forbidden torrents are left out.
+func (s *Server) scrape(q url.Values, addr net.IP) (d map[string]interface{}, err error) {
+	var hashes [][20]byte
+	for _, v := range q["info_hash"] {
+		if len(v) != 20 {
+			return nil, errors.New("Invalid info_hash.")
+		}
+		var ih [20]byte
+		copy(ih[:], v)
+		hashes = append(hashes, ih)
+	}
+	if len(hashes) == 0 {
+		hashes = s.Store.Public()
+	}
+	files := make(map[string]interface{}, len(hashes))
+	for _, ih := range hashes {
+		r, err := s.Store.Scrape(ih, addr)
+		if err != nil {
+			continue
+		}
+		files[string(ih[:])] = map[string]interface{}{
+			"complete":   r.Complete,
+			"downloaded": r.Downloaded,
+			"incomplete": r.Incomplete,
+		}
+	}
+	return map[string]interface{}{"files": files}, nil
+}
+
+func (s *Server) interval() time.Duration {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+	return DefaultInterval
+}
+
+func (s *Server) minInterval() time.Duration {
+	if s.MinInterval > 0 {
+		return s.MinInterval
+	}
+	return DefaultMinInterval
+}
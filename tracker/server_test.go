@@ -0,0 +1,165 @@
+package tracker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*Swarms, *httptest.Server) {
+	swarms := NewSwarms()
+	srv := httptest.NewServer(NewServer(swarms))
+	t.Cleanup(srv.Close)
+	return swarms, srv
+}
+
+func TestServerAnnounce(t *testing.T) {
+	swarms, srv := newTestServer(t)
+	req := testRequest()
+	ctx := context.Background()
+	c := NewHTTPClient(srv.URL + "/announce")
+	_, err := c.Announce(ctx, req)
+	if fe, ok := err.(*FailureError); !ok || fe.Reason != ErrUnknownTorrent.Error() {
+		t.Fatalf("Wanted unknown torrent, got %v", err)
+	}
+	swarms.Register(req.InfoHash)
+
+	// A seeder, an IPv6 leecher and then us.
+	seed := *req
+	seed.PeerID[19] = 's'
+	seed.Port, seed.Left = 7000, 0
+	if _, _, err = swarms.Announce(&seed, net.IP{10, 0, 0, 9}); err != nil {
+		t.Fatal(err)
+	}
+	v6 := *req
+	v6.PeerID[19] = '6'
+	v6.Port = 7001
+	if _, _, err = swarms.Announce(&v6, net.ParseIP("2001:db8::2")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Announce(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != DefaultInterval || resp.MinInterval != DefaultMinInterval || resp.Complete != 1 || resp.Incomplete != 2 {
+		t.Errorf("Got %+v", resp)
+	}
+	if len(resp.Peers) != 2 {
+		t.Fatalf("Got peers %v", resp.Peers)
+	}
+	for _, p := range resp.Peers {
+		if p.String() != "10.0.0.9:7000" && p.String() != "[2001:db8::2]:7001" {
+			t.Errorf("Unexpected peer %v", p)
+		}
+	}
+
+	// Dictionary peer lists, and seeders only get leechers.
+	q := url.Values{}
+	q.Set("info_hash", string(req.InfoHash[:]))
+	q.Set("peer_id", string(seed.PeerID[:]))
+	q.Set("port", "7000")
+	q.Set("left", "0")
+	q.Set("compact", "0")
+	q.Set("event", "completed")
+	d := get(t, srv.URL+"/announce?"+q.Encode())
+	if d != "d8:completei1e10:incompletei2e8:intervali1800e12:min intervali60e5:peersld2:ip9:127.0.0.17:peer id20:-TT0100-abcdefghijkl4:porti6881eed2:ip11:2001:db8::27:peer id20:-TT0100-abcdefghijk64:porti7001eeee" &&
+		d != "d8:completei1e10:incompletei2e8:intervali1800e12:min intervali60e5:peersld2:ip11:2001:db8::27:peer id20:-TT0100-abcdefghijk64:porti7001eed2:ip9:127.0.0.17:peer id20:-TT0100-abcdefghijkl4:porti6881eeee" {
+		t.Errorf("Got %q", d)
+	}
+
+	req.Event = Stopped
+	if resp, err = c.Announce(ctx, req); err != nil || resp.Incomplete != 1 {
+		t.Errorf("Stopped: %+v, %v", resp, err)
+	}
+	for _, bad := range []string{"info_hash=x", "port=0", "event=paused"} {
+		qq, _ := url.ParseQuery(q.Encode())
+		k, _ := url.ParseQuery(bad)
+		for name := range k {
+			qq.Set(name, k.Get(name))
+		}
+		if d := get(t, srv.URL+"/announce?"+qq.Encode()); d[:17] != "d14:failure reaso" {
+			t.Errorf("%s: got %q", bad, d)
+		}
+	}
+}
+
+func get(t *testing.T, u string) string {
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestServerScrapeAndWhitelist(t *testing.T) {
+	swarms, srv := newTestServer(t)
+	var pub, priv, other [20]byte
+	pub[0], priv[0], other[0] = 1, 2, 3
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	_, loop, _ := net.ParseCIDR("127.0.0.0/8")
+	swarms.Register(pub)
+	swarms.Register(priv, lan)
+	c := NewHTTPClient(srv.URL + "/announce")
+	ctx := context.Background()
+
+	req := testRequest()
+	req.InfoHash = priv
+	if _, err := c.Announce(ctx, req); err == nil {
+		t.Error("Announce to private torrent from outside the whitelist")
+	}
+	r, err := c.Scrape(ctx, pub, priv, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r[pub]; len(r) != 1 || !ok {
+		t.Errorf("Got %v", r)
+	}
+	swarms.Register(priv, lan, loop)
+	if _, err = c.Announce(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = c.Scrape(ctx, priv); err != nil || r[priv] != (ScrapeResult{Incomplete: 1}) {
+		t.Errorf("Got %v, %v", r, err)
+	}
+	// A full scrape only lists public torrents.
+	if r, err = c.Scrape(ctx); err != nil || len(r) != 1 {
+		t.Errorf("Full scrape got %v, %v", r, err)
+	}
+	if stats := swarms.Stats(); len(stats) != 2 || stats[priv].Incomplete != 1 {
+		t.Errorf("Got stats %v", stats)
+	}
+}
+
+func TestSwarmExpiry(t *testing.T) {
+	swarms := NewSwarms()
+	swarms.PeerTimeout = time.Minute
+	now := time.Unix(1000, 0)
+	swarms.now = func() time.Time { return now }
+	req := testRequest()
+	swarms.Register(req.InfoHash)
+	swarms.Announce(req, net.IP{10, 0, 0, 1})
+	now = now.Add(30 * time.Second)
+	other := *req
+	other.PeerID[0] = 'x'
+	if peers, _, _ := swarms.Announce(&other, net.IP{10, 0, 0, 2}); len(peers) != 1 {
+		t.Errorf("Got peers %v", peers)
+	}
+	now = now.Add(45 * time.Second)
+	if r, _ := swarms.Scrape(req.InfoHash, nil); r.Incomplete != 1 {
+		t.Errorf("Got %+v after expiry", r)
+	}
+	swarms.Unregister(req.InfoHash)
+	if _, err := swarms.Scrape(req.InfoHash, nil); err != ErrUnknownTorrent {
+		t.Errorf("Wanted ErrUnknownTorrent, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package tracker
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits on the number of peers handed out per announce.
+const (
+	DefaultNumWant = 50
+	MaxNumWant     = 200
+)
+
+// DefaultPeerTimeout is how long a peer stays in a swarm without
+// announcing.
+const DefaultPeerTimeout = time.Hour
+
+var (
+	ErrUnknownTorrent = errors.New("Torrent is not registered with this tracker.")
+	ErrNotAllowed     = errors.New("Peer is not allowed in this swarm.")
+)
+
+// Swarms is an in-memory Store tracking the peers of the torrents
+// registered with it. It is safe for concurrent use.
+type Swarms struct {
+	// PeerTimeout is how long peers are kept without announcing; zero
+	// means DefaultPeerTimeout.
+	PeerTimeout time.Duration
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*swarm
+	now      func() time.Time
+}
+
+type swarm struct {
+	allow      []*net.IPNet // Non-empty for private torrents.
+	peers      map[string]*swarmPeer
+	downloaded int
+}
+
+type swarmPeer struct {
+	Peer
+	left int64
+	seen time.Time
+}
+
+func NewSwarms() *Swarms {
+	return &Swarms{torrents: make(map[[20]byte]*swarm)}
+}
+
+func (s *Swarms) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Register adds a torrent. If allow is not empty the torrent is private:
+// only peers with an address in one of the networks may announce or scrape
+// it. Registering a torrent again replaces its whitelist and keeps its
+// peers.
+func (s *Swarms) Register(infoHash [20]byte, allow ...*net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sw, ok := s.torrents[infoHash]; ok {
+		sw.allow = allow
+		return
+	}
+	s.torrents[infoHash] = &swarm{allow: allow, peers: make(map[string]*swarmPeer)}
+}
+
+// Unregister removes a torrent and its swarm.
+func (s *Swarms) Unregister(infoHash [20]byte) {
+	s.mu.Lock()
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+}
+
+func (sw *swarm) allows(ip net.IP) bool {
+	if len(sw.allow) == 0 {
+		return true
+	}
+	for _, n := range sw.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops peers that have not announced within timeout.
+func (sw *swarm) expire(now time.Time, timeout time.Duration) {
+	for id, p := range sw.peers {
+		if now.Sub(p.seen) > timeout {
+			delete(sw.peers, id)
+		}
+	}
+}
+
+func (sw *swarm) stats() (r ScrapeResult) {
+	r.Downloaded = sw.downloaded
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			r.Complete++
+		} else {
+			r.Incomplete++
+		}
+	}
+	return
+}
+
+func (s *Swarms) peerTimeout() time.Duration {
+	if s.PeerTimeout > 0 {
+		return s.PeerTimeout
+	}
+	return DefaultPeerTimeout
+}
+
+// Announce records the peer announcing req from addr and returns a random
+// selection of other peers, along with the swarm's statistics. Seeders are
+// only given leechers.
+func (s *Swarms) Announce(req *AnnounceRequest, addr net.IP) (peers []Peer, stats ScrapeResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.torrents[req.InfoHash]
+	if !ok {
+		err = ErrUnknownTorrent
+		return
+	}
+	if !sw.allows(addr) {
+		err = ErrNotAllowed
+		return
+	}
+	now := s.clock()
+	sw.expire(now, s.peerTimeout())
+	id := string(req.PeerID[:])
+	if req.Event == Stopped {
+		delete(sw.peers, id)
+		stats = sw.stats()
+		return
+	}
+	p, ok := sw.peers[id]
+	if !ok {
+		p = &swarmPeer{Peer: Peer{ID: id}}
+		sw.peers[id] = p
+	}
+	if req.Event == Completed && p.left != 0 {
+		sw.downloaded++
+	}
+	p.IP, p.Port, p.left, p.seen = addr, req.Port, req.Left, now
+
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+	var candidates []Peer
+	for oid, o := range sw.peers {
+		if oid == id || (req.Left == 0 && o.left == 0) {
+			continue
+		}
+		candidates = append(candidates, o.Peer)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+	return candidates, sw.stats(), nil
+}
+
+// Scrape returns the statistics of a torrent as seen by a peer at addr.
+func (s *Swarms) Scrape(infoHash [20]byte, addr net.IP) (r ScrapeResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.torrents[infoHash]
+	if !ok {
+		return r, ErrUnknownTorrent
+	}
+	if !sw.allows(addr) {
+		return r, ErrNotAllowed
+	}
+	sw.expire(s.clock(), s.peerTimeout())
+	return sw.stats(), nil
+}
+
+// Stats returns the statistics of every registered torrent, private ones
+// included.
+func (s *Swarms) Stats() map[[20]byte]ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now, timeout := s.clock(), s.peerTimeout()
+	r := make(map[[20]byte]ScrapeResult, len(s.torrents))
+	for ih, sw := range s.torrents {
+		sw.expire(now, timeout)
+		r[ih] = sw.stats()
+	}
+	return r
+}
+
+// Public returns the info hashes of the torrents without a whitelist.
+func (s *Swarms) Public() (r [][20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ih, sw := range s.torrents {
+		if len(sw.allow) == 0 {
+			r = append(r, ih)
+		}
+	}
+	return
+}
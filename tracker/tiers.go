@@ -0,0 +1,298 @@
+package tracker
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults for Announcer.
+const (
+	DefaultRetryInterval = 15 * time.Second
+	DefaultStopTimeout   = 5 * time.Second
+)
+
+// Announcer announces one torrent to its trackers, organised in tiers as in
+// BEP 12. Each tier is shuffled once; its trackers are tried in order until
+// one responds, which is then moved to the front of the tier. Every tier
+// is announced to, and the peers from all of them are aggregated.
+//
+// Started is sent on the first announce to a tier, Completed once after
+// Complete is called, and Stopped when Run's context is cancelled. A
+// torrent that is complete from the start calls Complete before Run and
+// never reports Completed.
+type Announcer struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	Port     uint16
+	Key      uint32
+	NumWant  int
+	// Progress returns the totals to announce; nil means zeros.
+	Progress func() (uploaded, downloaded, left int64)
+	// OnPeers is called with each batch of peers that were not reported
+	// before. Calls are serialised.
+	OnPeers func(peers []Peer)
+	// OnError is called when an announce to a tracker fails; it may be
+	// nil.
+	OnError func(url string, err error)
+	// RetryInterval is the first delay before retrying a tier whose
+	// trackers all failed; it doubles on each failure up to
+	// DefaultInterval. Zero means DefaultRetryInterval.
+	RetryInterval time.Duration
+	// StopTimeout bounds the Stopped announces sent when Run returns.
+	// Zero means DefaultStopTimeout.
+	StopTimeout time.Duration
+	// NewClient creates the client for a tracker URL; nil means New.
+	NewClient func(url string) (Client, error)
+
+	mu        sync.Mutex
+	tiers     [][]string
+	clients   map[string]Client
+	seen      map[string]bool
+	complete  chan struct{}
+	completed bool
+	peersMu   sync.Mutex // Serialises OnPeers.
+}
+
+// NewAnnouncer returns an Announcer for the given tiers of tracker URLs,
+// such as those returned by MetaInfo.Trackers.
+func NewAnnouncer(tiers [][]string, infoHash, peerID [20]byte, port uint16) *Announcer {
+	a := &Announcer{
+		InfoHash: infoHash,
+		PeerID:   peerID,
+		Port:     port,
+		Key:      rand.Uint32(),
+		clients:  make(map[string]Client),
+		seen:     make(map[string]bool),
+		complete: make(chan struct{}),
+	}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		t := append([]string(nil), tier...)
+		rand.Shuffle(len(t), func(i, j int) { t[i], t[j] = t[j], t[i] })
+		a.tiers = append(a.tiers, t)
+	}
+	return a
+}
+
+// Tiers returns the current order of the trackers.
+func (a *Announcer) Tiers() [][]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := make([][]string, len(a.tiers))
+	for i, t := range a.tiers {
+		r[i] = append([]string(nil), t...)
+	}
+	return r
+}
+
+// Complete reports that the download has finished.
+func (a *Announcer) Complete() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.completed {
+		a.completed = true
+		close(a.complete)
+	}
+}
+
+func (a *Announcer) isComplete() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.completed
+}
+
+// Run announces until ctx is cancelled, then sends Stopped to the trackers
+// that were told about us, closes the clients and returns.
+func (a *Announcer) Run(ctx context.Context) {
+	seeding := a.isComplete()
+	var wg sync.WaitGroup
+	for i, _ := range a.tiers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a.runTier(ctx, i, seeding)
+		}(i)
+	}
+	wg.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for u, c := range a.clients {
+		if closer, ok := c.(io.Closer); ok {
+			closer.Close()
+		}
+		delete(a.clients, u)
+	}
+}
+
+func (a *Announcer) runTier(ctx context.Context, tier int, seeding bool) {
+	var started, completed bool
+	var wait time.Duration
+	retry := a.RetryInterval
+	if retry <= 0 {
+		retry = DefaultRetryInterval
+	}
+	failures := 0
+	for {
+		complete := a.complete
+		if !started || completed {
+			// Completion is reported with the next announce.
+			complete = nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if started {
+				a.stop(tier)
+			}
+			return
+		case <-timer.C:
+		case <-complete:
+			timer.Stop()
+		}
+		event := None
+		if !started {
+			event = Started
+		} else if !completed && a.isComplete() {
+			event = Completed
+		}
+		resp := a.announceTier(ctx, tier, event)
+		if resp == nil {
+			failures++
+			wait = retry << uint(failures-1)
+			if wait > DefaultInterval || wait <= 0 {
+				wait = DefaultInterval
+			}
+			continue
+		}
+		failures = 0
+		if event == Started {
+			started = true
+			// A torrent that was complete from the start is not
+			// reported as completed.
+			completed = seeding
+		}
+		if event == Completed {
+			completed = true
+		}
+		wait = resp.Interval
+		if wait <= 0 {
+			wait = DefaultInterval
+		}
+		if wait < resp.MinInterval {
+			wait = resp.MinInterval
+		}
+		a.deliver(resp.Peers)
+	}
+}
+
+func (a *Announcer) request(event Event) *AnnounceRequest {
+	req := &AnnounceRequest{
+		InfoHash: a.InfoHash,
+		PeerID:   a.PeerID,
+		Port:     a.Port,
+		Key:      a.Key,
+		NumWant:  a.NumWant,
+		Event:    event,
+	}
+	if a.Progress != nil {
+		req.Uploaded, req.Downloaded, req.Left = a.Progress()
+	}
+	return req
+}
+
+// announceTier tries the trackers of a tier in order and promotes the
+// first one that responds. It returns nil if none did.
+func (a *Announcer) announceTier(ctx context.Context, tier int, event Event) *AnnounceResponse {
+	a.mu.Lock()
+	urls := append([]string(nil), a.tiers[tier]...)
+	a.mu.Unlock()
+	req := a.request(event)
+	for _, u := range urls {
+		resp, err := a.announce(ctx, u, req)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if a.OnError != nil {
+				a.OnError(u, err)
+			}
+			continue
+		}
+		a.promote(tier, u)
+		return resp
+	}
+	return nil
+}
+
+func (a *Announcer) announce(ctx context.Context, u string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	a.mu.Lock()
+	c, ok := a.clients[u]
+	a.mu.Unlock()
+	if !ok {
+		newClient := a.NewClient
+		if newClient == nil {
+			newClient = New
+		}
+		var err error
+		if c, err = newClient(u); err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.clients[u] = c
+		a.mu.Unlock()
+	}
+	return c.Announce(ctx, req)
+}
+
+// promote moves u to the front of its tier.
+func (a *Announcer) promote(tier int, u string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t := a.tiers[tier]
+	for i, v := range t {
+		if v == u {
+			copy(t[1:i+1], t[:i])
+			t[0] = u
+			return
+		}
+	}
+}
+
+// stop sends Stopped to the tracker at the front of a tier.
+func (a *Announcer) stop(tier int) {
+	timeout := a.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	a.mu.Lock()
+	u := a.tiers[tier][0]
+	a.mu.Unlock()
+	if _, err := a.announce(ctx, u, a.request(Stopped)); err != nil && a.OnError != nil {
+		a.OnError(u, err)
+	}
+}
+
+// deliver passes the peers not seen before to OnPeers.
+func (a *Announcer) deliver(peers []Peer) {
+	a.peersMu.Lock()
+	defer a.peersMu.Unlock()
+	var fresh []Peer
+	for _, p := range peers {
+		k := p.String()
+		if !a.seen[k] {
+			a.seen[k] = true
+			fresh = append(fresh, p)
+		}
+	}
+	if len(fresh) > 0 && a.OnPeers != nil {
+		a.OnPeers(fresh)
+	}
+}
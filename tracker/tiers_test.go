@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClient records the events announced to it.
+type fakeClient struct {
+	mu     sync.Mutex
+	fail   bool
+	ok     int // Successful announces.
+	events []Event
+	peers  []Peer
+	sent   chan Event
+	closed bool
+}
+
+func (c *fakeClient) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, req.Event)
+	defer func() { c.sent <- req.Event }()
+	if c.fail {
+		return nil, errors.New("Unreachable.")
+	}
+	c.ok++
+	return &AnnounceResponse{Interval: time.Hour, Peers: c.peers}, nil
+}
+
+func (c *fakeClient) Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	return nil, ErrScrapeUnsupported
+}
+
+func (c *fakeClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeClient) Events() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Event(nil), c.events...)
+}
+
+func TestAnnouncer(t *testing.T) {
+	p1 := Peer{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	p2 := Peer{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	sent := make(chan Event, 100)
+	clients := map[string]*fakeClient{
+		"a": {fail: true, sent: sent},
+		"b": {peers: []Peer{p1}, sent: sent},
+		"c": {peers: []Peer{p1, p2}, sent: sent},
+	}
+	a := NewAnnouncer([][]string{{"a", "b"}, {"c"}, {}}, [20]byte{1}, [20]byte{2}, 6881)
+	a.NewClient = func(u string) (Client, error) {
+		if c, ok := clients[u]; ok {
+			return c, nil
+		}
+		return nil, errors.New("Unknown tracker.")
+	}
+	a.Progress = func() (int64, int64, int64) { return 0, 0, 100 }
+	var mu sync.Mutex
+	var got []Peer
+	a.OnPeers = func(peers []Peer) {
+		mu.Lock()
+		got = append(got, peers...)
+		mu.Unlock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	waitEvents := func(c *fakeClient, want ...Event) {
+		deadline := time.After(5 * time.Second)
+		for !reflect.DeepEqual(c.Events(), want) {
+			select {
+			case <-sent:
+			case <-deadline:
+				t.Fatalf("Got events %v, wanted %v", c.Events(), want)
+			}
+		}
+	}
+	waitEvents(clients["b"], Started)
+	waitEvents(clients["c"], Started)
+	if tiers := a.Tiers(); tiers[0][0] != "b" || len(tiers) != 2 {
+		t.Errorf("Working tracker not promoted: %v", tiers)
+	}
+	mu.Lock()
+	if len(got) != 2 {
+		t.Errorf("Got peers %v", got)
+	}
+	mu.Unlock()
+
+	a.Complete()
+	waitEvents(clients["b"], Started, Completed)
+	waitEvents(clients["c"], Started, Completed)
+	cancel()
+	<-done
+	waitEvents(clients["b"], Started, Completed, Stopped)
+	waitEvents(clients["c"], Started, Completed, Stopped)
+	for _, e := range clients["a"].Events() {
+		if e != Started {
+			t.Errorf("Failing tracker got %v", e)
+		}
+	}
+	for u, c := range clients {
+		c.mu.Lock()
+		// The failing tracker is only created if it was shuffled first.
+		if len(c.events) > 0 && !c.closed {
+			t.Errorf("Client %s was not closed", u)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestAnnouncerRetry(t *testing.T) {
+	sent := make(chan Event, 100)
+	c := &fakeClient{fail: true, sent: sent}
+	a := NewAnnouncer([][]string{{"x"}}, [20]byte{1}, [20]byte{2}, 6881)
+	a.NewClient = func(string) (Client, error) { return c, nil }
+	a.RetryInterval = time.Millisecond
+	a.Complete()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		<-sent
+	}
+	c.mu.Lock()
+	c.fail = false
+	c.mu.Unlock()
+	// Started is retried until it gets through; a torrent complete from
+	// the start never reports Completed.
+	for range sent {
+		c.mu.Lock()
+		ok := c.ok
+		c.mu.Unlock()
+		if ok > 0 {
+			break
+		}
+	}
+	cancel()
+	<-done
+	events := c.Events()
+	if events[len(events)-1] != Stopped {
+		t.Errorf("Got events %v", events)
+	}
+	for _, e := range events {
+		if e == Completed || e == None {
+			t.Errorf("Got events %v", events)
+		}
+	}
+}
+
+func TestAnnouncerCompleteBeforeStarted(t *testing.T) {
+	sent := make(chan Event, 100)
+	c := &fakeClient{fail: true, sent: sent}
+	a := NewAnnouncer([][]string{{"x"}}, [20]byte{1}, [20]byte{2}, 6881)
+	a.NewClient = func(string) (Client, error) { return c, nil }
+	a.RetryInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	<-sent
+	// The download finishes while Started is still failing.
+	a.Complete()
+	c.mu.Lock()
+	c.fail = false
+	c.mu.Unlock()
+	deadline := time.After(5 * time.Second)
+	for {
+		events := c.Events()
+		if events[len(events)-1] == Completed {
+			break
+		}
+		select {
+		case <-sent:
+		case <-deadline:
+			t.Fatalf("Got events %v", events)
+		}
+	}
+	cancel()
+	<-done
+}
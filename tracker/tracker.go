@@ -0,0 +1,144 @@
+// Package tracker implements the BitTorrent tracker protocols: announcing to
+// and scraping HTTP trackers (BEP 3, 7, 23, 48) and UDP trackers (BEP 15),
+// and embeddable HTTP and UDP trackers.
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Event is the event reported in an announce. The values are those of the
+// UDP tracker protocol.
+type Event int32
+
+const (
+	None Event = iota
+	Completed
+	Started
+	Stopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case None:
+		return ""
+	case Completed:
+		return "completed"
+	case Started:
+		return "started"
+	case Stopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("Event(%d)", int32(e))
+}
+
+// AnnounceRequest describes our state in a torrent's swarm.
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	IP         net.IP // Optional; the tracker uses the source address otherwise.
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	NumWant    int    // Number of peers wanted; zero lets the tracker decide.
+	Key        uint32 // Identifies us across IP changes.
+	TrackerID  string // Echoed from a previous response; HTTP only.
+}
+
+// Peer is a member of a swarm.
+type Peer struct {
+	IP   net.IP
+	Port uint16
+	ID   string // Only set by trackers sending dictionary peer lists.
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// AnnounceResponse is a tracker's answer to an announce.
+type AnnounceResponse struct {
+	Interval    time.Duration // Wait between regular announces.
+	MinInterval time.Duration // Never announce more often than this; zero if unset.
+	TrackerID   string
+	Warning     string
+	Complete    int // Seeders.
+	Incomplete  int // Leechers.
+	Peers       []Peer
+}
+
+// ScrapeResult holds the statistics of one torrent.
+type ScrapeResult struct {
+	Complete   int // Seeders.
+	Downloaded int // Number of completed downloads.
+	Incomplete int // Leechers.
+}
+
+// FailureError is returned when a tracker rejects a request with a reason.
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return "Tracker failure: " + e.Reason
+}
+
+// Client talks to a single tracker.
+type Client interface {
+	Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error)
+	Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error)
+}
+
+// New returns a client for the tracker at rawURL, which may have an http,
+// https or udp scheme.
+func New(rawURL string) (Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPClient(rawURL), nil
+	case "udp":
+		return NewUDPClient(rawURL)
+	}
+	return nil, fmt.Errorf("Unsupported tracker scheme %q.", u.Scheme)
+}
+
+// parseCompactPeers decodes peers packed as address and big endian port,
+// with addresses of n bytes.
+func parseCompactPeers(b []byte, n int) (peers []Peer, err error) {
+	if len(b)%(n+2) != 0 {
+		return nil, fmt.Errorf("Compact peer list has odd length %d.", len(b))
+	}
+	for ; len(b) > 0; b = b[n+2:] {
+		ip := make(net.IP, n)
+		copy(ip, b)
+		peers = append(peers, Peer{IP: ip, Port: uint16(b[n])<<8 | uint16(b[n+1])})
+	}
+	return
+}
+
+// appendCompactPeer packs p in the compact format, if its address has n
+// bytes.
+func appendCompactPeer(b []byte, p Peer, n int) []byte {
+	ip := p.IP.To4()
+	if n == net.IPv6len {
+		if ip != nil {
+			return b
+		}
+		ip = p.IP.To16()
+	}
+	if len(ip) != n {
+		return b
+	}
+	b = append(b, ip...)
+	return append(b, byte(p.Port>>8), byte(p.Port))
+}
@@ -0,0 +1,272 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The UDP tracker protocol (BEP 15).
+
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+
+	// MaxScrapeHashes is the number of info hashes that fit in one UDP
+	// scrape request.
+	MaxScrapeHashes = 74
+
+	maxUDPPacket = 64 * 1024
+)
+
+// Defaults for UDPClient, as specified by BEP 15.
+const (
+	DefaultUDPTimeout    = 15 * time.Second
+	DefaultUDPRetries    = 8
+	udpConnectionTimeout = time.Minute
+)
+
+var errShortResponse = errors.New("Tracker response is too short.")
+
+// UDPClient announces to a udp:// tracker. Requests are retransmitted after
+// Timeout*2^n for n up to MaxRetries, and the connection id is reused for
+// a minute. Requests are sent one at a time.
+type UDPClient struct {
+	Addr       string        // Host and port of the tracker.
+	Timeout    time.Duration // Zero means DefaultUDPTimeout.
+	MaxRetries int           // Zero means DefaultUDPRetries.
+
+	mu       sync.Mutex
+	conn     net.Conn
+	connID   uint64
+	connTime time.Time // When connID was obtained.
+	buf      []byte
+}
+
+// NewUDPClient returns a client for a tracker URL of the form
+// udp://host:port/...; the path is ignored.
+func NewUDPClient(announceURL string) (*UDPClient, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return nil, fmt.Errorf("Not a UDP tracker URL: %s", announceURL)
+	}
+	return &UDPClient{Addr: u.Host}, nil
+}
+
+// Close releases the client's socket.
+func (c *UDPClient) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		err = c.conn.Close()
+		c.conn = nil
+	}
+	return
+}
+
+func (c *UDPClient) Announce(ctx context.Context, req *AnnounceRequest) (resp *AnnounceResponse, err error) {
+	b := make([]byte, 0, 82)
+	b = append(b, req.InfoHash[:]...)
+	b = append(b, req.PeerID[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(req.Downloaded))
+	b = binary.BigEndian.AppendUint64(b, uint64(req.Left))
+	b = binary.BigEndian.AppendUint64(b, uint64(req.Uploaded))
+	b = binary.BigEndian.AppendUint32(b, uint32(req.Event))
+	var ip [4]byte
+	if ip4 := req.IP.To4(); ip4 != nil {
+		copy(ip[:], ip4)
+	}
+	b = append(b, ip[:]...)
+	b = binary.BigEndian.AppendUint32(b, req.Key)
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(numWant))
+	b = binary.BigEndian.AppendUint16(b, req.Port)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, err := c.request(ctx, actionAnnounce, b)
+	if err != nil {
+		return
+	}
+	if len(r) < 12 {
+		return nil, errShortResponse
+	}
+	resp = &AnnounceResponse{
+		Interval:   time.Duration(binary.BigEndian.Uint32(r)) * time.Second,
+		Incomplete: int(binary.BigEndian.Uint32(r[4:])),
+		Complete:   int(binary.BigEndian.Uint32(r[8:])),
+	}
+	// Peers have the address family of the socket the tracker answered
+	// on.
+	n := net.IPv4len
+	if addr, ok := c.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		n = net.IPv6len
+	}
+	if resp.Peers, err = parseCompactPeers(r[12:], n); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *UDPClient) Scrape(ctx context.Context, infoHashes ...[20]byte) (res map[[20]byte]ScrapeResult, err error) {
+	if len(infoHashes) > MaxScrapeHashes {
+		return nil, fmt.Errorf("Cannot scrape more than %d torrents at once.", MaxScrapeHashes)
+	}
+	b := make([]byte, 0, 20*len(infoHashes))
+	for _, ih := range infoHashes {
+		b = append(b, ih[:]...)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, err := c.request(ctx, actionScrape, b)
+	if err != nil {
+		return
+	}
+	if len(r) < 12*len(infoHashes) {
+		return nil, errShortResponse
+	}
+	res = make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for i, ih := range infoHashes {
+		e := r[12*i:]
+		res[ih] = ScrapeResult{
+			Complete:   int(binary.BigEndian.Uint32(e)),
+			Downloaded: int(binary.BigEndian.Uint32(e[4:])),
+			Incomplete: int(binary.BigEndian.Uint32(e[8:])),
+		}
+	}
+	return
+}
+
+// request sends an action with body, connecting first if needed, and
+// returns the body of the response. c.mu must be held.
+func (c *UDPClient) request(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	if c.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "udp", c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.buf = make([]byte, maxUDPPacket)
+	}
+	// Unblock reads if the context is cancelled. Wait for the watcher to
+	// exit so that it cannot touch the deadline of a later request.
+	done, exited := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+	}()
+	go func(conn net.Conn) {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}(c.conn)
+
+	maxRetries := c.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultUDPRetries
+	}
+	for n := 0; n <= maxRetries; n++ {
+		timeout := c.timeout() << uint(n)
+		if time.Since(c.connTime) > udpConnectionTimeout {
+			b := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+			r, err := c.exchange(ctx, b, actionConnect, nil, timeout)
+			if err != nil {
+				return nil, err
+			}
+			if r == nil {
+				continue
+			}
+			if len(r) < 8 {
+				return nil, errShortResponse
+			}
+			c.connID = binary.BigEndian.Uint64(r)
+			c.connTime = time.Now()
+		}
+		r, err := c.exchange(ctx, binary.BigEndian.AppendUint64(nil, c.connID), action, body, timeout)
+		if err != nil || r != nil {
+			return r, err
+		}
+	}
+	return nil, errors.New("UDP tracker did not respond.")
+}
+
+func (c *UDPClient) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultUDPTimeout
+}
+
+// exchange sends one packet and waits up to timeout for the matching
+// response. It returns a nil body if the wait timed out.
+func (c *UDPClient) exchange(ctx context.Context, prefix []byte, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	var tx [4]byte
+	if _, err := rand.Read(tx[:]); err != nil {
+		return nil, err
+	}
+	pkt := binary.BigEndian.AppendUint32(prefix, action)
+	pkt = append(append(pkt, tx[:]...), body...)
+	if _, err := c.conn.Write(pkt); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	ctxDeadline := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline, ctxDeadline = d, true
+	}
+	c.conn.SetReadDeadline(deadline)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if err = ctx.Err(); err != nil {
+					return nil, err
+				}
+				if ctxDeadline {
+					// The context's timer may not have fired yet.
+					return nil, context.DeadlineExceeded
+				}
+				return nil, nil
+			}
+			return nil, err
+		}
+		r := c.buf[:n]
+		// Drop stray packets, such as late answers to earlier attempts.
+		if len(r) < 8 || string(r[4:8]) != string(tx[:]) {
+			continue
+		}
+		switch got := binary.BigEndian.Uint32(r); got {
+		case action:
+			return append([]byte(nil), r[8:]...), nil
+		case actionError:
+			// The connection id may have expired on the tracker's side.
+			c.connTime = time.Time{}
+			return nil, &FailureError{string(r[8:])}
+		default:
+			return nil, fmt.Errorf("Tracker answered with action %d, wanted %d.", got, action)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpStandIn is a minimal UDP tracker that answers with canned data.
+type udpStandIn struct {
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	connects int
+	drop     int // Number of packets to ignore, to exercise retransmission.
+	fail     bool
+	last     []byte // Last announce body.
+}
+
+func newUDPStandIn(t *testing.T, network, addr string) *udpStandIn {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	s := &udpStandIn{conn: conn}
+	go s.serve()
+	return s
+}
+
+func (s *udpStandIn) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpStandIn) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p := buf[:n]
+		s.mu.Lock()
+		if s.drop > 0 {
+			s.drop--
+			s.mu.Unlock()
+			continue
+		}
+		action := binary.BigEndian.Uint32(p[8:])
+		resp := append(binary.BigEndian.AppendUint32(nil, action), p[12:16]...)
+		switch {
+		case s.fail:
+			resp = append(binary.BigEndian.AppendUint32(nil, actionError), p[12:16]...)
+			resp = append(resp, "no such torrent"...)
+		case action == actionConnect:
+			s.connects++
+			resp = binary.BigEndian.AppendUint64(resp, 0x1234)
+		case binary.BigEndian.Uint64(p) != 0x1234:
+			resp = append(binary.BigEndian.AppendUint32(nil, actionError), p[12:16]...)
+		case action == actionAnnounce:
+			s.last = append([]byte(nil), p[16:]...)
+			resp = append(resp, 0, 0, 0x07, 0x08, 0, 0, 0, 2, 0, 0, 0, 1)
+			if addr.(*net.UDPAddr).IP.To4() != nil {
+				resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1)
+			} else {
+				resp = append(resp, net.ParseIP("2001:db8::1")...)
+				resp = append(resp, 0x1a, 0xe1)
+			}
+		case action == actionScrape:
+			for i := 16; i < len(p); i += 20 {
+				resp = append(resp, 0, 0, 0, p[i], 0, 0, 0, 5, 0, 0, 0, 6)
+			}
+		}
+		s.mu.Unlock()
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	s := newUDPStandIn(t, "udp4", "127.0.0.1:0")
+	defer s.conn.Close()
+	c, err := NewUDPClient(s.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Timeout = 20 * time.Millisecond
+	s.mu.Lock()
+	s.drop = 2
+	s.mu.Unlock() // Lose a connect and then an announce.
+	req := testRequest()
+	req.IP = net.IPv4(1, 2, 3, 4)
+	resp, err := c.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &AnnounceResponse{Interval: 1800 * time.Second, Incomplete: 2, Complete: 1,
+		Peers: []Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("Got %+v, wanted %+v", resp, want)
+	}
+	s.mu.Lock()
+	body := s.last
+	s.mu.Unlock()
+	if len(body) != 82 || !bytes.Equal(body[:20], req.InfoHash[:]) || !bytes.Equal(body[20:40], req.PeerID[:]) {
+		t.Fatalf("Bad announce body %x", body)
+	}
+	if binary.BigEndian.Uint64(body[40:]) != 7 || binary.BigEndian.Uint64(body[48:]) != 1000 ||
+		binary.BigEndian.Uint64(body[56:]) != 5 || binary.BigEndian.Uint32(body[64:]) != uint32(Started) ||
+		!bytes.Equal(body[68:72], []byte{1, 2, 3, 4}) || binary.BigEndian.Uint32(body[72:]) != 0xdeadbeef ||
+		binary.BigEndian.Uint32(body[76:]) != 30 || binary.BigEndian.Uint16(body[80:]) != 6881 {
+		t.Errorf("Bad announce body %x", body)
+	}
+
+	// The connection id is reused.
+	if _, err = c.Scrape(context.Background(), req.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	if s.connects != 1 {
+		t.Errorf("Connected %d times", s.connects)
+	}
+
+	s.fail = true
+	s.mu.Unlock()
+	_, err = c.Announce(context.Background(), req)
+	if fe, ok := err.(*FailureError); !ok || fe.Reason != "no such torrent" {
+		t.Errorf("Wanted failure, got %v", err)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	s := newUDPStandIn(t, "udp4", "127.0.0.1:0")
+	defer s.conn.Close()
+	c, _ := NewUDPClient(s.url())
+	defer c.Close()
+	var a, b [20]byte
+	a[0], b[0] = 1, 2
+	r, err := c.Scrape(context.Background(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[20]byte]ScrapeResult{a: {1, 5, 6}, b: {2, 5, 6}}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("Got %v, wanted %v", r, want)
+	}
+}
+
+func TestUDPIPv6(t *testing.T) {
+	s := newUDPStandIn(t, "udp6", "[::1]:0")
+	defer s.conn.Close()
+	c, _ := NewUDPClient(s.url())
+	defer c.Close()
+	resp, err := c.Announce(context.Background(), testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || !resp.Peers[0].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Got peers %v", resp.Peers)
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, _ := NewUDPClient("udp://" + conn.LocalAddr().String())
+	defer c.Close()
+	c.Timeout = 5 * time.Millisecond
+	c.MaxRetries = 2
+	start := time.Now()
+	if _, err = c.Announce(context.Background(), testRequest()); err == nil {
+		t.Fatal("Silent tracker answered")
+	}
+	// 5 + 10 + 20 ms of retransmission backoff.
+	if d := time.Since(start); d < 35*time.Millisecond {
+		t.Errorf("Gave up after %v", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Timeout = time.Hour
+	if _, err = c.Announce(ctx, testRequest()); err != context.DeadlineExceeded {
+		t.Errorf("Wanted DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if c, err := New("udp://tracker.example.com:1337/announce"); err != nil || c.(*UDPClient).Addr != "tracker.example.com:1337" {
+		t.Errorf("Got %v, %v", c, err)
+	}
+	if c, err := New("https://tracker.example.com/announce"); err != nil || c.(*HTTPClient).URL != "https://tracker.example.com/announce" {
+		t.Errorf("Got %v, %v", c, err)
+	}
+	for _, bad := range []string{"wss://tracker.example.com", "udp://tracker.example.com"} {
+		if _, err := New(bad); err == nil {
+			t.Errorf("New(%q) should fail", bad)
+		}
+	}
+}
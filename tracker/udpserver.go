@@ -0,0 +1,249 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for UDPServer.
+const (
+	// DefaultSecretRotation is how often connection ids change. An id is
+	// accepted for up to two rotations, covering the two minutes BEP 15
+	// asks for.
+	DefaultSecretRotation = time.Minute
+	// DefaultRateLimit and DefaultRateBurst bound the requests accepted
+	// from one source address, per second and in a burst.
+	DefaultRateLimit = 5
+	DefaultRateBurst = 20
+)
+
+// UDPServer serves the UDP tracker protocol (BEP 15) for the torrents in
+// Store. Connection ids are derived from the client's address and a secret
+// that is rotated regularly, so the server keeps no per-connection state.
+// Requests beyond the rate limit of their source address are dropped
+// without an answer.
+type UDPServer struct {
+	Store          Store
+	Interval       time.Duration // Zero means DefaultInterval.
+	SecretRotation time.Duration // Zero means DefaultSecretRotation.
+	RateLimit      float64       // Requests per second; zero means DefaultRateLimit.
+	RateBurst      int           // Zero means DefaultRateBurst.
+
+	mu      sync.Mutex
+	secrets [2][32]byte // Current and previous secret.
+	rotated time.Time
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewUDPServer(store Store) *UDPServer {
+	return &UDPServer{Store: store}
+}
+
+func (s *UDPServer) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Serve answers requests on conn until reading from it fails, as it does
+// once conn is closed.
+func (s *UDPServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if resp := s.handle(buf[:n], ua); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// handle returns the response to packet p from addr, or nil to send none.
+func (s *UDPServer) handle(p []byte, addr *net.UDPAddr) []byte {
+	if len(p) < 16 {
+		return nil
+	}
+	ip := normalizeIP(addr.IP)
+	now := s.clock()
+	s.mu.Lock()
+	s.rotate(now)
+	allowed := s.allow(ip, now)
+	s.mu.Unlock()
+	if !allowed {
+		return nil
+	}
+	id := binary.BigEndian.Uint64(p)
+	action := binary.BigEndian.Uint32(p[8:])
+	tx := p[12:16]
+	resp := append(binary.BigEndian.AppendUint32(make([]byte, 0, 1024), action), tx...)
+	if action == actionConnect {
+		if id != udpProtocolID {
+			return nil
+		}
+		s.mu.Lock()
+		cid := s.connectionID(0, addr)
+		s.mu.Unlock()
+		return binary.BigEndian.AppendUint64(resp, cid)
+	}
+	s.mu.Lock()
+	valid := id == s.connectionID(0, addr) || id == s.connectionID(1, addr)
+	s.mu.Unlock()
+	if !valid {
+		return udpError(tx, "Invalid connection id.")
+	}
+	switch action {
+	case actionAnnounce:
+		return s.announce(resp, p[16:], ip)
+	case actionScrape:
+		body := p[16:]
+		if len(body) == 0 || len(body)%20 != 0 || len(body)/20 > MaxScrapeHashes {
+			return udpError(tx, "Invalid scrape request.")
+		}
+		for ; len(body) > 0; body = body[20:] {
+			var ih [20]byte
+			copy(ih[:], body)
+			// Unknown and forbidden torrents are reported as empty.
+			r, _ := s.Store.Scrape(ih, ip)
+			resp = binary.BigEndian.AppendUint32(resp, uint32(r.Complete))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(r.Downloaded))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(r.Incomplete))
+		}
+		return resp
+	}
+	return udpError(tx, "Unknown action.")
+}
+
+func (s *UDPServer) announce(resp, body []byte, ip net.IP) []byte {
+	tx := resp[4:8]
+	if len(body) < 82 {
+		return udpError(tx, "Invalid announce request.")
+	}
+	req := new(AnnounceRequest)
+	copy(req.InfoHash[:], body)
+	copy(req.PeerID[:], body[20:])
+	req.Downloaded = int64(binary.BigEndian.Uint64(body[40:]))
+	req.Left = int64(binary.BigEndian.Uint64(body[48:]))
+	req.Uploaded = int64(binary.BigEndian.Uint64(body[56:]))
+	req.Event = Event(binary.BigEndian.Uint32(body[64:]))
+	// The ip field is ignored; peers are recorded at their source address.
+	req.Key = binary.BigEndian.Uint32(body[72:])
+	if numWant := int32(binary.BigEndian.Uint32(body[76:])); numWant > 0 {
+		req.NumWant = int(numWant)
+	}
+	req.Port = binary.BigEndian.Uint16(body[80:])
+	if req.Event > Stopped {
+		return udpError(tx, "Invalid event.")
+	}
+	peers, stats, err := s.Store.Announce(req, ip)
+	if err != nil {
+		return udpError(tx, err.Error())
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	resp = binary.BigEndian.AppendUint32(resp, uint32(interval/time.Second))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(stats.Incomplete))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(stats.Complete))
+	// Peers must have the address family of the request.
+	n := net.IPv4len
+	if ip.To4() == nil {
+		n = net.IPv6len
+	}
+	for _, p := range peers {
+		resp = appendCompactPeer(resp, p, n)
+	}
+	return resp
+}
+
+func udpError(tx []byte, msg string) []byte {
+	resp := append(binary.BigEndian.AppendUint32(nil, actionError), tx...)
+	return append(resp, msg...)
+}
+
+// rotate replaces the secret once per elapsed rotation period and forgets
+// idle rate limit buckets. s.mu must be held.
+func (s *UDPServer) rotate(now time.Time) {
+	period := s.SecretRotation
+	if period <= 0 {
+		period = DefaultSecretRotation
+	}
+	if s.rotated.IsZero() {
+		// No previous secret yet.
+		rand.Read(s.secrets[0][:])
+		s.secrets[1] = s.secrets[0]
+		s.rotated = now
+		return
+	}
+	steps := now.Sub(s.rotated) / period
+	if steps < 1 {
+		return
+	}
+	s.secrets[1] = s.secrets[0]
+	rand.Read(s.secrets[0][:])
+	if steps > 1 {
+		// The previous secret also expired while we were idle.
+		s.secrets[1] = s.secrets[0]
+	}
+	s.rotated = s.rotated.Add(steps * period)
+	for k, b := range s.buckets {
+		if now.Sub(b.last) > period {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+// connectionID returns the id for addr under secret i. s.mu must be held.
+func (s *UDPServer) connectionID(i int, addr *net.UDPAddr) uint64 {
+	mac := hmac.New(sha256.New, s.secrets[i][:])
+	mac.Write(addr.IP.To16())
+	mac.Write([]byte{byte(addr.Port >> 8), byte(addr.Port)})
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// allow takes a token from the bucket of ip. s.mu must be held.
+func (s *UDPServer) allow(ip net.IP, now time.Time) bool {
+	rate, burst := s.RateLimit, s.RateBurst
+	if rate <= 0 {
+		rate = DefaultRateLimit
+	}
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[string]*bucket)
+	}
+	b, ok := s.buckets[string(ip)]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[string(ip)] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,147 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startUDPServer(t *testing.T, s *UDPServer) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestUDPServer(t *testing.T) {
+	swarms := NewSwarms()
+	req := testRequest()
+	swarms.Register(req.InfoHash)
+	var other [20]byte
+	other[0] = 1
+	swarms.Register(other)
+
+	// The HTTP and UDP trackers share the swarms.
+	srv := httptest.NewServer(NewServer(swarms))
+	defer srv.Close()
+	seed := *req
+	seed.PeerID[0], seed.Left, seed.Port = 'S', 0, 7000
+	if _, err := NewHTTPClient(srv.URL+"/announce").Announce(context.Background(), &seed); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewUDPClient(startUDPServer(t, NewUDPServer(swarms)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Timeout = 100 * time.Millisecond
+	resp, err := c.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != DefaultInterval || resp.Complete != 1 || resp.Incomplete != 1 ||
+		len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:7000" {
+		t.Errorf("Got %+v", resp)
+	}
+	var unknown [20]byte
+	unknown[0] = 2
+	r, err := c.Scrape(context.Background(), req.InfoHash, other, unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[req.InfoHash] != (ScrapeResult{Complete: 1, Incomplete: 1}) || r[other] != (ScrapeResult{}) || len(r) != 3 {
+		t.Errorf("Got %v", r)
+	}
+	req.InfoHash = unknown
+	if _, err = c.Announce(context.Background(), req); err == nil || err.Error() != (&FailureError{ErrUnknownTorrent.Error()}).Error() {
+		t.Errorf("Wanted unknown torrent, got %v", err)
+	}
+}
+
+func udpPacket(id uint64, action uint32, body []byte) []byte {
+	p := binary.BigEndian.AppendUint64(nil, id)
+	p = binary.BigEndian.AppendUint32(p, action)
+	p = append(p, 't', 'x', 'i', 'd')
+	return append(p, body...)
+}
+
+func TestUDPServerConnectionID(t *testing.T) {
+	s := NewUDPServer(NewSwarms())
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	resp := s.handle(udpPacket(udpProtocolID, actionConnect, nil), addr)
+	if len(resp) != 16 || string(resp[4:8]) != "txid" {
+		t.Fatalf("Got connect response %x", resp)
+	}
+	id := binary.BigEndian.Uint64(resp[8:])
+	scrape := func(id uint64, addr *net.UDPAddr) uint32 {
+		return binary.BigEndian.Uint32(s.handle(udpPacket(id, actionScrape, make([]byte, 20)), addr))
+	}
+	if got := scrape(id, addr); got != actionScrape {
+		t.Errorf("Valid id got action %d", got)
+	}
+	if got := scrape(id, &net.UDPAddr{IP: addr.IP, Port: 6882}); got != actionError {
+		t.Errorf("Id of another address got action %d", got)
+	}
+	if s.handle(udpPacket(1, actionConnect, nil), addr) != nil {
+		t.Error("Connect without the protocol id answered")
+	}
+	// Ids survive one rotation but not two.
+	now = now.Add(DefaultSecretRotation)
+	if got := scrape(id, addr); got != actionScrape {
+		t.Errorf("Id rejected after one rotation: %d", got)
+	}
+	now = now.Add(DefaultSecretRotation)
+	if got := scrape(id, addr); got != actionError {
+		t.Errorf("Id accepted after two rotations: %d", got)
+	}
+	// Rotations are not skipped while the server is idle.
+	resp = s.handle(udpPacket(udpProtocolID, actionConnect, nil), addr)
+	id = binary.BigEndian.Uint64(resp[8:])
+	now = now.Add(2*DefaultSecretRotation + time.Second)
+	if got := scrape(id, addr); got != actionError {
+		t.Errorf("Id accepted after an idle gap of two rotations: %d", got)
+	}
+	resp = s.handle(udpPacket(udpProtocolID, actionConnect, nil), addr)
+	id = binary.BigEndian.Uint64(resp[8:])
+	now = now.Add(DefaultSecretRotation + time.Second)
+	if got := scrape(id, addr); got != actionScrape {
+		t.Errorf("Id rejected after an idle gap of one rotation: %d", got)
+	}
+}
+
+func TestUDPServerRateLimit(t *testing.T) {
+	s := NewUDPServer(NewSwarms())
+	s.RateLimit, s.RateBurst = 1, 3
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	connect := udpPacket(udpProtocolID, actionConnect, nil)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+	answered := 0
+	for i := 0; i < 5; i++ {
+		// Changing ports does not escape the limit.
+		a.Port = i
+		if s.handle(connect, a) != nil {
+			answered++
+		}
+	}
+	if answered != 3 {
+		t.Errorf("Answered %d of 5 requests", answered)
+	}
+	if s.handle(connect, b) == nil {
+		t.Error("Other address was limited")
+	}
+	now = now.Add(time.Second)
+	if s.handle(connect, a) == nil {
+		t.Error("Limit did not refill")
+	}
+}
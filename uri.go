@@ -1,20 +1,35 @@
 package taipei
 
 import (
-	"crypto/sha1"
+	"bytes"
 	"fmt"
-	"io"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// Magnet holds the parameters of a magnet URI.
 type Magnet struct {
-	InfoHashes []string
+	InfoHashes   []InfoHash   // xt: "urn:btih:" exact topics.
+	InfoHashesV2 []InfoHashV2 // xt: "urn:btmh:" exact topics (BEP 52).
+	DisplayName  string       // dn: display name.
+	Trackers     []string     // tr: tracker URLs.
+	WebSeeds     []string     // ws: web seed URLs (BEP 19).
+	Length       int64        // xl: exact length in bytes, 0 if unknown.
+	SelectOnly   []Range      // so: indices of the files to download (BEP 53).
+	Peers        []string     // x.pe: peer addresses as host:port (BEP 9).
+	Keywords     []string     // kt: keywords for search.
+	// Params holds every parameter not listed above, so that they survive
+	// a round trip.
+	Params url.Values
 }
 
-func parseMagnet(s string) (Magnet, error) {
+// ParseMagnet parses a magnet URI.
+func ParseMagnet(s string) (Magnet, error) {
 	// References:
 	// - http://bittorrent.org/beps/bep_0009.html
+	// - http://bittorrent.org/beps/bep_0053.html
 	// - http://en.wikipedia.org/wiki/Magnet_URI_scheme
 	//
 	// Example bittorrent magnet link:
@@ -23,49 +38,202 @@ func parseMagnet(s string) (Magnet, error) {
 	//
 	// xt: exact topic.
 	//   ~ urn: uniform resource name.
-	//   ~ btih: bittorrent infohash. 
+	//   ~ btih: bittorrent infohash, in hex or base32.
+	//   ~ btmh: bittorrent v2 infohash, as a hex multihash.
 	// dn: display name (optional).
 	// tr: address tracker (optional).
+	// ws: web seed (optional).
+	// xl: exact length (optional).
+	// so: select only, e.g. "0,2,4,6-8" (optional).
+	// x.pe: peer address (optional).
+	// kt: keyword topic (optional).
 	u, err := url.Parse(s)
 	if err != nil {
 		return Magnet{}, err
 	}
-	xts, ok := u.Query()["xt"]
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("Not a magnet URI: %s", s)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Magnet{}, err
+	}
+	xts, ok := query["xt"]
 	if !ok {
-		return Magnet{}, fmt.Errorf("Magnet URI missing the 'xt' argument: " + s)
+		return Magnet{}, fmt.Errorf("Magnet URI missing the 'xt' argument: %s", s)
 	}
-	infoHashes := make([]string, 0, len(xts))
+	var m Magnet
 	for _, xt := range xts {
-		s := strings.Split(xt, "urn:btih:")
-		if len(s) != 2 {
-			return Magnet{}, fmt.Errorf("Magnet URI xt parameter missing the 'urn:btih:' prefix. Not a bittorrent hash link?")
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			var ih InfoHash
+			if ih, err = parseBtih(xt[len("urn:btih:"):]); err != nil {
+				return Magnet{}, err
+			}
+			m.InfoHashes = append(m.InfoHashes, ih)
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			var ih InfoHashV2
+			if ih, err = parseBtmh(xt[len("urn:btmh:"):]); err != nil {
+				return Magnet{}, err
+			}
+			m.InfoHashesV2 = append(m.InfoHashesV2, ih)
+		default:
+			// Topics of other networks, such as ed2k, are kept as is.
+			if m.Params == nil {
+				m.Params = make(url.Values)
+			}
+			m.Params.Add("xt", xt)
 		}
-		ih := s[1]
-		// TODO: support base32 encoded hashes, if they still exist.
-		if len(ih) != sha1.Size*2 { // hex format.
-			return Magnet{}, fmt.Errorf("Magnet URI contains infohash with unexpected length. Wanted %d, got %d: %v", sha1.Size, len(ih), ih)
+	}
+	if len(m.InfoHashes) == 0 && len(m.InfoHashesV2) == 0 {
+		return Magnet{}, fmt.Errorf("Magnet URI xt parameter missing the 'urn:btih:' or 'urn:btmh:' prefix. Not a bittorrent hash link?")
+	}
+	for k, vs := range query {
+		switch k {
+		case "xt":
+		case "dn":
+			m.DisplayName = vs[0]
+		case "tr":
+			m.Trackers = vs
+		case "ws":
+			m.WebSeeds = vs
+		case "xl":
+			if m.Length, err = strconv.ParseInt(vs[0], 10, 64); err != nil || m.Length < 0 {
+				return Magnet{}, fmt.Errorf("Magnet URI has invalid exact length %q.", vs[0])
+			}
+		case "so":
+			for _, v := range vs {
+				var r []Range
+				if r, err = parseSelectOnly(v); err != nil {
+					return Magnet{}, err
+				}
+				m.SelectOnly = append(m.SelectOnly, r...)
+			}
+		case "x.pe":
+			m.Peers = vs
+		case "kt":
+			for _, v := range vs {
+				m.Keywords = append(m.Keywords, strings.Fields(v)...)
+			}
+		default:
+			if m.Params == nil {
+				m.Params = make(url.Values)
+			}
+			m.Params[k] = vs
 		}
-		infoHashes = append(infoHashes, s[1])
 	}
-	return Magnet{infoHashes}, nil
+	return m, nil
 }
 
-// torrentFromMagnet fetches the content of a torrent meta file from the magnet
-// uri. It only uses the first infohash found in the URI.
-func torrentFromMagnet(uri string) (torrentBody io.ReadCloser, err error) {
-	m, err := parseMagnet(uri)
-	if err != nil {
-		return nil, err
+// String encodes m as a magnet URI that ParseMagnet reads back.
+func (m Magnet) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("magnet:?")
+	sep := ""
+	add := func(k, v string) {
+		buf.WriteString(sep)
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(v)
+		sep = "&"
+	}
+	for _, ih := range m.InfoHashes {
+		add("xt", "urn:btih:"+ih.String())
+	}
+	for _, ih := range m.InfoHashesV2 {
+		add("xt", "urn:btmh:"+ih.Multihash())
+	}
+	for _, xt := range m.Params["xt"] {
+		add("xt", url.QueryEscape(xt))
+	}
+	if m.DisplayName != "" {
+		add("dn", url.QueryEscape(m.DisplayName))
+	}
+	if m.Length > 0 {
+		add("xl", strconv.FormatInt(m.Length, 10))
+	}
+	for _, tr := range m.Trackers {
+		add("tr", url.QueryEscape(tr))
+	}
+	for _, ws := range m.WebSeeds {
+		add("ws", url.QueryEscape(ws))
+	}
+	if len(m.SelectOnly) > 0 {
+		so := make([]string, len(m.SelectOnly))
+		for i, r := range m.SelectOnly {
+			so[i] = r.String()
+		}
+		add("so", strings.Join(so, ","))
+	}
+	for _, pe := range m.Peers {
+		add("x.pe", url.QueryEscape(pe))
+	}
+	if len(m.Keywords) > 0 {
+		add("kt", url.QueryEscape(strings.Join(m.Keywords, " ")))
+	}
+	keys := make([]string, 0, len(m.Params))
+	for k := range m.Params {
+		if k != "xt" {
+			keys = append(keys, k)
+		}
 	}
-	if len(m.InfoHashes) == 0 {
-		return nil, fmt.Errorf("No bittorrent infohashes found in the magnet link %v.", uri)
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range m.Params[k] {
+			add(url.QueryEscape(k), url.QueryEscape(v))
+		}
 	}
-	ih := m.InfoHashes[0]
-	return nil, fmt.Errorf("Not supported. Would have downloaded torrent file with hash %v", ih)
+	return buf.String()
+}
 
-	// Start a torrent session to download the magnet file.
-	//
-	// References:
-	// - http://bittorrent.org/beps/bep_0009.html
-	// TODO: Refactor the torrent code to support multiple sessions per client.
+// Magnet returns the magnet link of the torrent. It carries the v1 and, for
+// v2 torrents, the v2 info hash, the name, the total length, every tracker
+// and the web seeds.
+func (m *MetaInfo) Magnet() Magnet {
+	var mag Magnet
+	if !m.InfoHash.IsZero() {
+		mag.InfoHashes = []InfoHash{m.InfoHash}
+	}
+	if !m.InfoHashV2.IsZero() {
+		mag.InfoHashesV2 = []InfoHashV2{m.InfoHashV2}
+	}
+	mag.DisplayName = m.Info.Name
+	mag.Length = m.Info.Length
+	for _, f := range m.Info.Files {
+		mag.Length += f.Length
+	}
+	seen := make(map[string]bool)
+	addTracker := func(tr string) {
+		if tr != "" && !seen[tr] {
+			seen[tr] = true
+			mag.Trackers = append(mag.Trackers, tr)
+		}
+	}
+	addTracker(m.Announce)
+	for _, tier := range m.AnnounceList {
+		for _, tr := range tier {
+			addTracker(tr)
+		}
+	}
+	mag.WebSeeds = m.UrlList
+	return mag
+}
+
+// parseSelectOnly parses a BEP 53 file index list such as "0,2,4,6-8".
+func parseSelectOnly(s string) (r []Range, err error) {
+	for _, part := range strings.Split(s, ",") {
+		first, last := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		var f, l int
+		if f, err = strconv.Atoi(first); err == nil {
+			l, err = strconv.Atoi(last)
+		}
+		if err != nil || f < 0 || l < f {
+			return nil, fmt.Errorf("Magnet URI has invalid select-only entry %q.", part)
+		}
+		r = append(r, Range{f, l})
+	}
+	return
 }
@@ -1,7 +1,10 @@
 package taipei
 
 import (
+	"encoding/json"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -13,15 +16,221 @@ type magnetTest struct {
 func TestParseMagnet(t *testing.T) {
 	uris := []magnetTest{
 		{uri: "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu-12.04-desktop-i386.iso&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80&tr=udp%3A%2F%2Ftracker.publicbt.com%3A80&tr=udp%3A%2F%2Ftracker.istole.it%3A6969&tr=udp%3A%2F%2Ftracker.ccc.de%3A80", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
+		{uri: "magnet:?xt=urn:btih:BBB6DB69965AF769F664B6636E7914F8735141B3", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
+		{uri: "magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQNT", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
+		{uri: "magnet:?xt=urn:btih:xo3nw2mwll3wt5tewzrw46iu7bzvcqnt&xt=urn:ed2k:354B15E68FB8F36D7CD88FF94116CDC1", infoHashes: []string{"bbb6db69965af769f664b6636e7914f8735141b3"}},
 	}
 
 	for _, u := range uris {
-		m, err := parseMagnet(u.uri)
+		m, err := ParseMagnet(u.uri)
 		if err != nil {
 			t.Errorf("ParseMagnet failed for uri %v: %v", u.uri, err)
 		}
-		if !reflect.DeepEqual(u.infoHashes, m.InfoHashes) {
-			t.Errorf("ParseMagnet failed, wanted %v, got %v", u.infoHashes, m.InfoHashes)
+		var got []string
+		for _, ih := range m.InfoHashes {
+			got = append(got, ih.String())
 		}
+		if !reflect.DeepEqual(u.infoHashes, got) {
+			t.Errorf("ParseMagnet failed, wanted %v, got %v", u.infoHashes, got)
+		}
+	}
+}
+
+func TestParseMagnetFields(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&dn=Ubuntu+12.04" +
+		"&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Ft2.example.com%2Fannounce" +
+		"&ws=http%3A%2F%2Fseed.example.com%2Fubuntu.iso&xl=733419520&so=0,2,4-6" +
+		"&x.pe=10.0.0.1%3A6881&x.pe=%5B%3A%3A1%5D%3A6882&kt=linux+ubuntu&as=http%3A%2F%2Fa.example.com&x.foo=bar"
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Magnet{
+		InfoHashes:  []InfoHash{mustParseBtih("bbb6db69965af769f664b6636e7914f8735141b3")},
+		DisplayName: "Ubuntu 12.04",
+		Trackers:    []string{"udp://tracker.example.com:80", "http://t2.example.com/announce"},
+		WebSeeds:    []string{"http://seed.example.com/ubuntu.iso"},
+		Length:      733419520,
+		SelectOnly:  []Range{{0, 0}, {2, 2}, {4, 6}},
+		Peers:       []string{"10.0.0.1:6881", "[::1]:6882"},
+		Keywords:    []string{"linux", "ubuntu"},
+		Params:      url.Values{"as": {"http://a.example.com"}, "x.foo": {"bar"}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("ParseMagnet = %+v\nwanted %+v", m, want)
+	}
+	for _, bad := range []string{
+		"http://example.com/?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3",
+		"magnet:?dn=foo",
+		"magnet:?xt=urn:ed2k:354B15E68FB8F36D7CD88FF94116CDC1",
+		"magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141",
+		"magnet:?xt=urn:btih:XO3NW2MWLL3WT5TEWZRW46IU7BZVCQN1",
+		"magnet:?xt=urn:btmh:1114bbb6db69965af769f664b6636e7914f8735141b3",
+		"magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&xl=-1",
+		"magnet:?xt=urn:btih:bbb6db69965af769f664b6636e7914f8735141b3&so=3-1",
+	} {
+		if _, err := ParseMagnet(bad); err == nil {
+			t.Errorf("ParseMagnet(%q) should fail", bad)
+		}
+	}
+	// The input is quoted verbatim, not used as a format.
+	bad := "http://example.com/?q=%25d"
+	if _, err := ParseMagnet(bad); err == nil || err.Error() != "Not a magnet URI: "+bad {
+		t.Errorf("ParseMagnet(%q) = %v", bad, err)
+	}
+}
+
+func mustParseBtih(s string) InfoHash {
+	ih, err := parseBtih(s)
+	if err != nil {
+		panic(err)
+	}
+	return ih
+}
+
+func mustParseBtmh(s string) InfoHashV2 {
+	ih, err := parseBtmh(s)
+	if err != nil {
+		panic(err)
+	}
+	return ih
+}
+
+func TestParseMagnetHybrid(t *testing.T) {
+	// Hybrid v1/v2 magnet from the BEP 52 test torrents.
+	uri := "magnet:?xt=urn:btih:631a31dd0a46257d5078c0dee4e66e26f73e42ac" +
+		"&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb&dn=bittorrent-v1-v2-hybrid-test"
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.InfoHashes) != 1 || m.InfoHashes[0].String() != "631a31dd0a46257d5078c0dee4e66e26f73e42ac" {
+		t.Errorf("Wrong v1 info hashes %v", m.InfoHashes)
+	}
+	if len(m.InfoHashesV2) != 1 || m.InfoHashesV2[0].String() != "d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb" {
+		t.Errorf("Wrong v2 info hashes %v", m.InfoHashesV2)
+	}
+	if m.Params != nil {
+		t.Errorf("Unexpected params %v", m.Params)
+	}
+}
+
+func TestMagnetString(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:631a31dd0a46257d5078c0dee4e66e26f73e42ac" +
+		"&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb" +
+		"&dn=a+b%26c&xl=42&tr=udp%3A%2F%2Ftracker.example.com%3A80%2Fannounce%3Fx%3D1%26y%3D2" +
+		"&ws=http%3A%2F%2Fseed.example.com%2Fa+b&so=0,2-3&x.pe=10.0.0.1%3A6881&kt=foo+bar" +
+		"&as=http%3A%2F%2Fa.example.com"
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := m.String(); s != uri {
+		t.Errorf("String = %v\nwanted   %v", s, uri)
+	}
+}
+
+func TestMetaInfoMagnet(t *testing.T) {
+	torrent := "d8:announce27:http://t1.example.com/a?b=c13:announce-listll27:http://t1.example.com/a?b=c" +
+		"el23:udp://t2.example.com:80ee4:infod6:lengthi1024e12:meta versioni2e4:name9:test 1&.z" +
+		"12:piece lengthi32768e6:pieces20:aaaaaaaaaaaaaaaaaaaae8:url-list22:http://ws.example.com/e"
+	m, err := DecodeMetaInfo([]byte(torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mag := m.Magnet()
+	want := Magnet{
+		DisplayName: "test 1&.z",
+		Length:      1024,
+		Trackers:    []string{"http://t1.example.com/a?b=c", "udp://t2.example.com:80"},
+		WebSeeds:    []string{"http://ws.example.com/"},
+	}
+	want.InfoHashes = []InfoHash{mustParseBtih("8434a716ac411d35372d388efd75421854caf6cb")}
+	want.InfoHashesV2 = []InfoHashV2{mustParseBtmh("1220f8bfd48a72a07b7374b790c1056e6f906187b5a3a9231eaa1c7df0796322e53f")}
+	if !reflect.DeepEqual(mag, want) {
+		t.Errorf("Magnet = %+v\nwanted %+v", mag, want)
+	}
+	back, err := ParseMagnet(mag.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, mag) {
+		t.Errorf("Round trip = %+v\nwanted %+v", back, mag)
+	}
+}
+
+func TestMetaInfoTrackers(t *testing.T) {
+	m := &MetaInfo{Announce: "http://a.example.com/announce"}
+	if got := m.Trackers(); !reflect.DeepEqual(got, [][]string{{"http://a.example.com/announce"}}) {
+		t.Errorf("Got %v", got)
+	}
+	m.AnnounceList = [][]string{{"udp://b.example.com:80", "udp://c.example.com:80"}, {"http://d.example.com/announce"}}
+	got := m.Trackers()
+	if !reflect.DeepEqual(got, m.AnnounceList) {
+		t.Errorf("Got %v", got)
+	}
+	got[0][0] = "changed"
+	if m.AnnounceList[0][0] == "changed" {
+		t.Error("Trackers shares its slices with the MetaInfo")
+	}
+	if got := new(MetaInfo).Trackers(); got != nil {
+		t.Errorf("Got %v without trackers", got)
+	}
+}
+
+func TestMetaInfoNodes(t *testing.T) {
+	torrent := "d4:infod6:lengthi1024e4:name4:test12:piece lengthi32768e6:pieces20:aaaaaaaaaaaaaaaaaaaae" +
+		"5:nodesll9:127.0.0.1i6881eel8:2001:db8i6882eel3:badel3:fooi0eeee"
+	m, err := DecodeMetaInfo([]byte(torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:6881", "[2001:db8]:6882"}; !reflect.DeepEqual(m.Nodes, want) {
+		t.Errorf("Nodes = %v, wanted %v", m.Nodes, want)
+	}
+}
+
+func TestInfoHashForms(t *testing.T) {
+	ih := mustParseBtih("bbb6db69965af769f664b6636e7914f8735141b3")
+	if ih.Base32() != "XO3NW2MWLL3WT5TEWZRW46IU7BZVCQNT" {
+		t.Errorf("Base32 = %v", ih.Base32())
+	}
+	for _, s := range []string{ih.String(), strings.ToUpper(ih.String()), ih.Base32(), strings.ToLower(ih.Base32())} {
+		if got, err := ParseInfoHash(s); err != nil || got != ih {
+			t.Errorf("ParseInfoHash(%q) = %v, %v", s, got, err)
+		}
+	}
+	if got, err := ParseInfoHashURL(ih.URLEncoded()); err != nil || got != ih {
+		t.Errorf("ParseInfoHashURL(%q) = %v, %v", ih.URLEncoded(), got, err)
+	}
+	if _, err := ParseInfoHashURL("%bb%b6"); err == nil {
+		t.Error("ParseInfoHashURL should reject short hashes")
+	}
+	js, err := json.Marshal(map[string]InfoHash{"ih": ih})
+	if err != nil || string(js) != `{"ih":"bbb6db69965af769f664b6636e7914f8735141b3"}` {
+		t.Errorf("json.Marshal = %s, %v", js, err)
+	}
+	var back map[string]InfoHash
+	if err = json.Unmarshal(js, &back); err != nil || back["ih"] != ih {
+		t.Errorf("json.Unmarshal = %v, %v", back, err)
+	}
+	other := ih
+	other[19]++
+	if ih.Compare(other) != -1 || other.Compare(ih) != 1 || ih.Compare(ih) != 0 {
+		t.Error("Compare is wrong")
+	}
+
+	v2 := mustParseBtmh("1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb")
+	for _, s := range []string{v2.String(), v2.Base32(), v2.Multihash()} {
+		if got, err := ParseInfoHashV2(s); err != nil || got != v2 {
+			t.Errorf("ParseInfoHashV2(%q) = %v, %v", s, got, err)
+		}
+	}
+	if v2.Truncated().String() != "d8dd32ac93357c368556af3ac1d95c9d76bd0dff" {
+		t.Errorf("Truncated = %v", v2.Truncated())
+	}
+	var v2back InfoHashV2
+	if err = v2back.UnmarshalText([]byte(v2.String())); err != nil || v2back != v2 {
+		t.Errorf("UnmarshalText = %v, %v", v2back, err)
 	}
 }
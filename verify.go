@@ -76,7 +76,7 @@ func VerifySingle(m *MetaInfo, root string) (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		fs.files = []fileEntry{{stat.Size(), fd}}
+		fs.files = []fileEntry{{length: stat.Size(), fd: fd}}
 		fs.offsets = []int64{0}
 		size = stat.Size()
 	} else {
@@ -114,7 +114,7 @@ func VerifyFull(m *MetaInfo, root string) (bool, error) {
 				return false, err
 			}
 			defer fd.Close()
-			fs.files = append(fs.files, fileEntry{src.Length, fd})
+			fs.files = append(fs.files, fileEntry{length: src.Length, fd: fd})
 			fs.offsets = append(fs.offsets, size)
 			size += src.Length
 		}
@@ -154,7 +154,7 @@ func VerifyPartial(m *MetaInfo, root string) (bool, error) {
 				}
 				defer fd.Close()
 			}
-			fs.files = append(fs.files, fileEntry{src.Length, fd})
+			fs.files = append(fs.files, fileEntry{length: src.Length, fd: fd})
 			fs.offsets = append(fs.offsets, size)
 			size += src.Length
 		}
@@ -0,0 +1,403 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// The extension protocol (BEP 10). Extensions are negotiated with an
+// extended handshake in which each side maps extension names to the message
+// ids it wants to receive them under.
+
+// ExtendedHandshakeID is the extended message id of the handshake.
+const ExtendedHandshakeID = 0
+
+var (
+	ErrBadExtendedHandshake = errors.New("Malformed extended handshake.")
+	ErrNotNegotiated        = errors.New("Extension was not negotiated with the peer.")
+)
+
+// ExtendedHandshake is the payload of the extended handshake.
+type ExtendedHandshake struct {
+	M            map[string]byte // Extension name to message id; 0 disables.
+	V            string          // Client name and version.
+	P            uint16          // Local TCP listen port.
+	Reqq         int             // Outstanding request queue size.
+	MetadataSize int             // Size of the info dictionary (BEP 9).
+	YourIP       net.IP          // Address of the receiving peer, as seen by the sender.
+	// Extra holds other keys, for extensions that add their own.
+	Extra map[string]interface{}
+}
+
+func (h *ExtendedHandshake) MarshalBinary() ([]byte, error) {
+	d := make(map[string]interface{}, len(h.Extra)+6)
+	for k, v := range h.Extra {
+		d[k] = v
+	}
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = int(id)
+	}
+	d["m"] = m
+	if h.V != "" {
+		d["v"] = h.V
+	}
+	if h.P != 0 {
+		d["p"] = int(h.P)
+	}
+	if h.Reqq != 0 {
+		d["reqq"] = h.Reqq
+	}
+	if h.MetadataSize != 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		d["yourip"] = string(ip4)
+	} else if len(h.YourIP) == net.IPv6len {
+		d["yourip"] = string(h.YourIP)
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *ExtendedHandshake) UnmarshalBinary(b []byte) error {
+	_, err := h.unmarshal(b)
+	return err
+}
+
+// unmarshal decodes b into h and reports which keys b holds.
+func (h *ExtendedHandshake) unmarshal(b []byte) (present map[string]bool, err error) {
+	d, _, err := DecodeDict(b)
+	if err != nil {
+		return
+	}
+	*h = ExtendedHandshake{M: make(map[string]byte)}
+	present = make(map[string]bool, len(d))
+	for k, v := range d {
+		present[k] = true
+		switch k {
+		case "m":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, ErrBadExtendedHandshake
+			}
+			for name, idv := range m {
+				id, ok := idv.(int64)
+				if !ok || id < 0 || id > 255 {
+					return nil, ErrBadExtendedHandshake
+				}
+				h.M[name] = byte(id)
+			}
+		case "v":
+			h.V, _ = v.(string)
+		case "p":
+			if p, ok := v.(int64); ok && p > 0 && p <= 65535 {
+				h.P = uint16(p)
+			}
+		case "reqq":
+			if n, ok := v.(int64); ok && n > 0 {
+				h.Reqq = int(n)
+			}
+		case "metadata_size":
+			if n, ok := v.(int64); ok && n > 0 {
+				h.MetadataSize = int(n)
+			}
+		case "yourip":
+			if s, ok := v.(string); ok && (len(s) == net.IPv4len || len(s) == net.IPv6len) {
+				h.YourIP = net.IP(s)
+			}
+		default:
+			if h.Extra == nil {
+				h.Extra = make(map[string]interface{})
+			}
+			h.Extra[k] = v
+		}
+	}
+	return
+}
+
+// update returns h with the keys present in later overlaid on it. Later
+// handshakes carry only what changed (BEP 10). h itself is left untouched.
+func (h *ExtendedHandshake) update(later *ExtendedHandshake, present map[string]bool) *ExtendedHandshake {
+	u := *h
+	u.M = make(map[string]byte, len(h.M)+len(later.M))
+	for name, id := range h.M {
+		u.M[name] = id
+	}
+	for name, id := range later.M {
+		u.M[name] = id
+	}
+	if present["v"] {
+		u.V = later.V
+	}
+	if present["p"] {
+		u.P = later.P
+	}
+	if present["reqq"] {
+		u.Reqq = later.Reqq
+	}
+	if present["metadata_size"] {
+		u.MetadataSize = later.MetadataSize
+	}
+	if present["yourip"] {
+		u.YourIP = later.YourIP
+	}
+	if len(later.Extra) > 0 {
+		u.Extra = make(map[string]interface{}, len(h.Extra)+len(later.Extra))
+		for k, v := range h.Extra {
+			u.Extra[k] = v
+		}
+		for k, v := range later.Extra {
+			u.Extra[k] = v
+		}
+	}
+	return &u
+}
+
+// ExtendedMessage builds an Extended message with the given extended id.
+func ExtendedMessage(id byte, payload []byte) *Message {
+	return &Message{Type: Extended, Payload: append([]byte{id}, payload...)}
+}
+
+// DecodeDict decodes the bencoded dictionary at the start of b and returns
+// the bytes following it, such as the data of a ut_metadata piece.
+func DecodeDict(b []byte) (dict map[string]interface{}, rest []byte, err error) {
+	n, err := bencodeLen(b)
+	if err != nil {
+		return
+	}
+	v, err := bencode.Decode(bytes.NewReader(b[:n]))
+	if err != nil {
+		return
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		err = errors.New("Bencoded value is not a dictionary.")
+		return
+	}
+	return dict, b[n:], nil
+}
+
+// EncodeDict bencodes d followed by trailer.
+func EncodeDict(d map[string]interface{}, trailer []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, d); err != nil {
+		return nil, err
+	}
+	buf.Write(trailer)
+	return buf.Bytes(), nil
+}
+
+var errBadBencode = errors.New("Malformed bencoded value.")
+
+// bencodeLen returns the length of the bencoded value at the start of b.
+func bencodeLen(b []byte) (int, error) {
+	return bencodeSkip(b, 0, 0)
+}
+
+func bencodeSkip(b []byte, i, depth int) (int, error) {
+	if depth > 64 || i >= len(b) {
+		return 0, errBadBencode
+	}
+	switch c := b[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(b[i:], 'e')
+		if end < 0 {
+			return 0, errBadBencode
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var err error
+			if i, err = bencodeSkip(b, i, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(b) {
+			return 0, errBadBencode
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b[i:], ':')
+		if colon < 0 {
+			return 0, errBadBencode
+		}
+		n := 0
+		for _, d := range b[i : i+colon] {
+			if d < '0' || d > '9' || n > len(b) {
+				return 0, errBadBencode
+			}
+			n = n*10 + int(d-'0')
+		}
+		end := i + colon + 1 + n
+		if end > len(b) {
+			return 0, errBadBencode
+		}
+		return end, nil
+	}
+	return 0, errBadBencode
+}
+
+// ExtensionHandler receives the extended messages of one extension.
+type ExtensionHandler interface {
+	HandleExtended(p *ExtendedPeer, payload []byte) error
+}
+
+// ExtensionHandlerFunc adapts a function to ExtensionHandler.
+type ExtensionHandlerFunc func(p *ExtendedPeer, payload []byte) error
+
+func (f ExtensionHandlerFunc) HandleExtended(p *ExtendedPeer, payload []byte) error {
+	return f(p, payload)
+}
+
+// HandshakeHandler may be implemented by an ExtensionHandler to be told
+// when a peer that supports the extension sends its extended handshake.
+type HandshakeHandler interface {
+	HandleExtendedHandshake(p *ExtendedPeer) error
+}
+
+// Registry holds the extensions a client supports. Register every
+// extension before creating peers; the registry is then safe to share
+// between connections.
+type Registry struct {
+	names    []string
+	ids      map[string]byte
+	handlers map[byte]ExtensionHandler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{ids: make(map[string]byte), handlers: make(map[byte]ExtensionHandler)}
+}
+
+// Register adds the extension name and returns the message id it is
+// received under.
+func (r *Registry) Register(name string, h ExtensionHandler) (byte, error) {
+	if _, ok := r.ids[name]; ok {
+		return 0, fmt.Errorf("Extension %q is already registered.", name)
+	}
+	if len(r.names) == 255 {
+		return 0, errors.New("Too many extensions.")
+	}
+	id := byte(len(r.names) + 1)
+	r.names = append(r.names, name)
+	r.ids[name] = id
+	r.handlers[id] = h
+	return id, nil
+}
+
+// Handshake returns an extended handshake announcing every registered
+// extension. Callers fill in the other fields as needed.
+func (r *Registry) Handshake() *ExtendedHandshake {
+	h := &ExtendedHandshake{M: make(map[string]byte, len(r.ids))}
+	for name, id := range r.ids {
+		h.M[name] = id
+	}
+	return h
+}
+
+// NewPeer returns the extension state of a new connection whose messages
+// are written to w.
+func (r *Registry) NewPeer(w *Writer) *ExtendedPeer {
+	return &ExtendedPeer{registry: r, w: w}
+}
+
+// ExtendedPeer tracks the extensions negotiated with one peer.
+type ExtendedPeer struct {
+	registry *Registry
+	w        *Writer
+
+	mu     sync.Mutex
+	remote *ExtendedHandshake
+	// Context is left for the caller, e.g. to find its own peer state
+	// from a handler.
+	Context interface{}
+}
+
+// SendHandshake sends our extended handshake.
+func (p *ExtendedPeer) SendHandshake(h *ExtendedHandshake) error {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return p.w.WriteMessage(ExtendedMessage(ExtendedHandshakeID, b))
+}
+
+// Remote returns the peer's extended handshake, or nil if it has not been
+// received yet. The handshake is shared and must not be modified; later
+// handshakes replace it rather than change it.
+func (p *ExtendedPeer) Remote() *ExtendedHandshake {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remote
+}
+
+// Supports reports whether the peer announced the extension name.
+func (p *ExtendedPeer) Supports(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remote != nil && p.remote.M[name] != 0
+}
+
+// Send sends payload to the peer as a message of extension name, using the
+// id the peer asked for.
+func (p *ExtendedPeer) Send(name string, payload []byte) error {
+	p.mu.Lock()
+	var id byte
+	if p.remote != nil {
+		id = p.remote.M[name]
+	}
+	p.mu.Unlock()
+	if id == 0 {
+		return ErrNotNegotiated
+	}
+	return p.w.WriteMessage(ExtendedMessage(id, payload))
+}
+
+// Handle processes an Extended message from the peer: the handshake is
+// recorded, other messages are dispatched to the handler registered under
+// their id. Messages for unknown ids are ignored.
+func (p *ExtendedPeer) Handle(m *Message) error {
+	if m.Type != Extended || len(m.Payload) == 0 {
+		return ErrBadLength
+	}
+	id, payload := m.Payload[0], m.Payload[1:]
+	if id != ExtendedHandshakeID {
+		if h, ok := p.registry.handlers[id]; ok {
+			return h.HandleExtended(p, payload)
+		}
+		return nil
+	}
+	h := new(ExtendedHandshake)
+	present, err := h.unmarshal(payload)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.remote != nil {
+		// Later handshakes update a copy of the previous one, so that
+		// callers of Remote may keep reading the old one.
+		h = p.remote.update(h, present)
+	}
+	p.remote = h
+	p.mu.Unlock()
+	for _, name := range p.registry.names {
+		if h.M[name] == 0 {
+			continue
+		}
+		if hh, ok := p.registry.handlers[p.registry.ids[name]].(HandshakeHandler); ok {
+			if err := hh.HandleExtendedHandshake(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
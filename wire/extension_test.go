@@ -0,0 +1,175 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestExtendedHandshake(t *testing.T) {
+	h := &ExtendedHandshake{
+		M:            map[string]byte{"ut_metadata": 1, "ut_pex": 2, "lt_donthave": 0},
+		V:            "taipei 0.1",
+		P:            6881,
+		Reqq:         250,
+		MetadataSize: 31235,
+		YourIP:       net.IPv4(10, 1, 2, 3).To4(),
+		Extra:        map[string]interface{}{"x_custom": "value"},
+	}
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "d1:md11:lt_donthavei0e11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v10:taipei 0.18:x_custom5:value6:yourip4:\n\x01\x02\x03e"
+	if string(b) != want {
+		t.Errorf("Got %q\nwanted %q", b, want)
+	}
+	var back ExtendedHandshake
+	if err = back.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&back, h) {
+		t.Errorf("Got %+v, wanted %+v", back, h)
+	}
+	for _, bad := range []string{"", "le", "d1:mi1ee", "d1:md1:ai256eee", "d1:md1:ai-1eee", "d1:m"} {
+		if err := back.UnmarshalBinary([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalBinary(%q) should fail", bad)
+		}
+	}
+}
+
+func TestRegistryDispatch(t *testing.T) {
+	// Two peers with different id assignments talk over a pipe.
+	var got []string
+	regA := NewRegistry()
+	regA.Register("ut_pex", ExtensionHandlerFunc(func(p *ExtendedPeer, payload []byte) error {
+		got = append(got, "pex:"+string(payload))
+		return nil
+	}))
+	regA.Register("ut_metadata", ExtensionHandlerFunc(func(p *ExtendedPeer, payload []byte) error {
+		got = append(got, "metadata:"+string(payload))
+		return nil
+	}))
+	regB := NewRegistry()
+	handshakes := 0
+	regB.Register("ut_metadata", handshakeCounter{&handshakes})
+	regB.Register("x_unknown", handshakeCounter{&handshakes})
+
+	var aToB, bToA bytes.Buffer
+	a := regA.NewPeer(NewWriter(&aToB))
+	b := regB.NewPeer(NewWriter(&bToA))
+	if err := b.Send("ut_metadata", nil); err != ErrNotNegotiated {
+		t.Errorf("Wanted ErrNotNegotiated, got %v", err)
+	}
+	if err := a.SendHandshake(regA.Handshake()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SendHandshake(regB.Handshake()); err != nil {
+		t.Fatal(err)
+	}
+	pump := func(from *bytes.Buffer, to *ExtendedPeer) {
+		r := NewReader(from)
+		for from.Len() > 0 {
+			m, err := r.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = to.Handle(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pump(&aToB, b)
+	pump(&bToA, a)
+	if handshakes != 1 {
+		t.Errorf("Wanted one handshake callback for the shared extension, got %d", handshakes)
+	}
+	if !b.Supports("ut_metadata") || !b.Supports("ut_pex") || b.Supports("x_unknown") {
+		t.Error("Wrong negotiated extensions")
+	}
+	if err := b.Send("ut_metadata", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send("ut_pex", []byte("peers")); err != nil {
+		t.Fatal(err)
+	}
+	// Messages under ids nobody registered are dropped.
+	NewWriter(&bToA).WriteMessage(ExtendedMessage(9, []byte("junk")))
+	pump(&bToA, a)
+	if want := []string{"metadata:hello", "pex:peers"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, wanted %v", got, want)
+	}
+}
+
+func TestRemoteHandshakeUpdate(t *testing.T) {
+	p := NewRegistry().NewPeer(NewWriter(new(bytes.Buffer)))
+	handshake := func(m map[string]byte) *Message {
+		b, _ := (&ExtendedHandshake{M: m}).MarshalBinary()
+		return ExtendedMessage(ExtendedHandshakeID, b)
+	}
+	b, _ := (&ExtendedHandshake{M: map[string]byte{"ut_pex": 1}, V: "taipei", MetadataSize: 1234}).MarshalBinary()
+	if err := p.Handle(ExtendedMessage(ExtendedHandshakeID, b)); err != nil {
+		t.Fatal(err)
+	}
+	first := p.Remote()
+	// Readers of an earlier handshake do not race with later ones.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = first.M["ut_pex"]
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := p.Handle(handshake(map[string]byte{"ut_metadata": byte(i%10 + 2)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if len(first.M) != 1 {
+		t.Errorf("Earlier handshake was modified: %v", first.M)
+	}
+	if m := p.Remote().M; m["ut_pex"] != 1 || m["ut_metadata"] != 11 {
+		t.Errorf("Got merged extensions %v", m)
+	}
+	// Fields missing from later handshakes keep their earlier values.
+	if r := p.Remote(); r.V != "taipei" || r.MetadataSize != 1234 {
+		t.Errorf("Got updated handshake %+v", r)
+	}
+	b, _ = (&ExtendedHandshake{MetadataSize: 99}).MarshalBinary()
+	if err := p.Handle(ExtendedMessage(ExtendedHandshakeID, b)); err != nil {
+		t.Fatal(err)
+	}
+	if r := p.Remote(); r.V != "taipei" || r.MetadataSize != 99 || first.MetadataSize != 1234 {
+		t.Errorf("Got updated handshake %+v", r)
+	}
+}
+
+type handshakeCounter struct {
+	n *int
+}
+
+func (h handshakeCounter) HandleExtended(*ExtendedPeer, []byte) error {
+	return nil
+}
+
+func (h handshakeCounter) HandleExtendedHandshake(*ExtendedPeer) error {
+	*h.n++
+	return nil
+}
+
+func TestDecodeDict(t *testing.T) {
+	d, rest, err := DecodeDict([]byte("d8:msg_typei1e5:piecei0eeDATA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["msg_type"] != int64(1) || string(rest) != "DATA" {
+		t.Errorf("Got %v, %q", d, rest)
+	}
+	for _, bad := range []string{"d", "d3:abc", "li1ee", "d99999999999999999999:e", "x"} {
+		if _, _, err := DecodeDict([]byte(bad)); err == nil {
+			t.Errorf("DecodeDict(%q) should fail", bad)
+		}
+	}
+}
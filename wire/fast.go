@@ -0,0 +1,43 @@
+package wire
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// DefaultAllowedFast is the size of the allowed fast set suggested by
+// BEP 6.
+const DefaultAllowedFast = 10
+
+// AllowedFastSet returns the k pieces, out of numPieces, that a peer at ip
+// may request while choked, using the canonical algorithm of BEP 6. The
+// BEP only defines the set for IPv4 peers; nil is returned for other
+// addresses.
+func AllowedFastSet(infoHash [20]byte, ip net.IP, numPieces, k int) []uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 || k <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	// Peers in the same /24 get the same set.
+	buf := make([]byte, 0, 4+len(infoHash))
+	buf = append(buf, ip4[0], ip4[1], ip4[2], 0)
+	buf = append(buf, infoHash[:]...)
+	x := sha1.Sum(buf)
+	set := make([]uint32, 0, k)
+	seen := make(map[uint32]bool, k)
+	for len(set) < k {
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[4*i:]) % uint32(numPieces)
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+		x = sha1.Sum(x[:])
+	}
+	return set
+}
@@ -0,0 +1,37 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// Test vectors from BEP 6.
+	var ih [20]byte
+	copy(ih[:], bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.ParseIP("80.4.4.200")
+	tests := []struct {
+		k    int
+		want []uint32
+	}{
+		{7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{9, []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+	for _, test := range tests {
+		if got := AllowedFastSet(ih, ip, 1313, test.k); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("k=%d: got %v, wanted %v", test.k, got, test.want)
+		}
+	}
+	// The last octet of the address does not matter.
+	if got := AllowedFastSet(ih, net.ParseIP("80.4.4.1"), 1313, 7); !reflect.DeepEqual(got, tests[0].want) {
+		t.Errorf("Same /24 got %v", got)
+	}
+	if got := AllowedFastSet(ih, ip, 3, DefaultAllowedFast); len(got) != 3 {
+		t.Errorf("Set of a 3 piece torrent has %d pieces", len(got))
+	}
+	if got := AllowedFastSet(ih, net.ParseIP("2001:db8::1"), 1313, 7); got != nil {
+		t.Errorf("IPv6 peer got %v", got)
+	}
+}
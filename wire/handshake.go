@@ -0,0 +1,105 @@
+// Package wire implements the BitTorrent peer wire protocol (BEP 3): the
+// handshake and the length-prefixed messages exchanged after it, with the
+// fast extension (BEP 6), the extension protocol (BEP 10) and peer exchange
+// (BEP 11).
+package wire
+
+import (
+	"errors"
+	"io"
+)
+
+const Protocol = "BitTorrent protocol"
+
+// HandshakeLength is the size of a handshake on the wire.
+const HandshakeLength = 1 + len(Protocol) + 8 + 20 + 20
+
+var ErrBadProtocol = errors.New("Peer does not speak the BitTorrent protocol.")
+
+// Handshake is the first message sent in each direction on a connection.
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// Reserved bits announcing protocol extensions, as byte index and mask.
+const (
+	reservedDHTByte       = 7
+	reservedDHTMask       = 0x01
+	reservedFastByte      = 7
+	reservedFastMask      = 0x04
+	reservedExtensionByte = 5
+	reservedExtensionMask = 0x10
+)
+
+// SetExtensions sets the bit announcing the extension protocol (BEP 10).
+func (h *Handshake) SetExtensions() {
+	h.Reserved[reservedExtensionByte] |= reservedExtensionMask
+}
+
+// SupportsExtensions reports whether the extension protocol bit is set.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[reservedExtensionByte]&reservedExtensionMask != 0
+}
+
+// SetDHT sets the bit announcing DHT support (BEP 5).
+func (h *Handshake) SetDHT() {
+	h.Reserved[reservedDHTByte] |= reservedDHTMask
+}
+
+func (h *Handshake) SupportsDHT() bool {
+	return h.Reserved[reservedDHTByte]&reservedDHTMask != 0
+}
+
+// SetFast sets the bit announcing the fast extension (BEP 6).
+func (h *Handshake) SetFast() {
+	h.Reserved[reservedFastByte] |= reservedFastMask
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[reservedFastByte]&reservedFastMask != 0
+}
+
+func (h *Handshake) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, HandshakeLength)
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	return buf, nil
+}
+
+func (h *Handshake) UnmarshalBinary(buf []byte) error {
+	if len(buf) != HandshakeLength || int(buf[0]) != len(Protocol) || string(buf[1:20]) != Protocol {
+		return ErrBadProtocol
+	}
+	copy(h.Reserved[:], buf[20:28])
+	copy(h.InfoHash[:], buf[28:48])
+	copy(h.PeerID[:], buf[48:68])
+	return nil
+}
+
+func WriteHandshake(w io.Writer, h *Handshake) error {
+	buf, _ := h.MarshalBinary()
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadHandshake(r io.Reader) (h Handshake, err error) {
+	var buf [HandshakeLength]byte
+	// Check the protocol header before waiting for the rest.
+	if _, err = io.ReadFull(r, buf[:20]); err != nil {
+		return
+	}
+	if int(buf[0]) != len(Protocol) || string(buf[1:20]) != Protocol {
+		err = ErrBadProtocol
+		return
+	}
+	if _, err = io.ReadFull(r, buf[20:]); err != nil {
+		return
+	}
+	err = h.UnmarshalBinary(buf[:])
+	return
+}
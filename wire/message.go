@@ -0,0 +1,288 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MessageType byte
+
+const (
+	Choke MessageType = iota
+	Unchoke
+	Interested
+	NotInterested
+	Have
+	Bitfield
+	Request
+	Piece
+	Cancel
+	Port // DHT listen port (BEP 5).
+
+	// Fast extension (BEP 6).
+	Suggest       MessageType = 13
+	HaveAll       MessageType = 14
+	HaveNone      MessageType = 15
+	RejectRequest MessageType = 16
+	AllowedFast   MessageType = 17
+
+	Extended MessageType = 20 // Extension protocol (BEP 10).
+)
+
+var messageNames = map[MessageType]string{
+	Choke:         "choke",
+	Unchoke:       "unchoke",
+	Interested:    "interested",
+	NotInterested: "not interested",
+	Have:          "have",
+	Bitfield:      "bitfield",
+	Request:       "request",
+	Piece:         "piece",
+	Cancel:        "cancel",
+	Port:          "port",
+	Suggest:       "suggest",
+	HaveAll:       "have all",
+	HaveNone:      "have none",
+	RejectRequest: "reject request",
+	AllowedFast:   "allowed fast",
+	Extended:      "extended",
+}
+
+func (t MessageType) String() string {
+	if s, ok := messageNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("MessageType(%d)", byte(t))
+}
+
+const (
+	// MaxBlockLength is the largest block a request may ask for. Peers
+	// normally use 16 KiB.
+	MaxBlockLength = 128 * 1024
+	// DefaultMaxLength bounds the length of incoming messages: a piece
+	// message carrying a block of MaxBlockLength.
+	DefaultMaxLength = 1 + 8 + MaxBlockLength
+)
+
+var (
+	ErrMessageTooLong = errors.New("Peer message is too long.")
+	ErrBadLength      = errors.New("Peer message has the wrong length for its type.")
+	ErrBadBitfield    = errors.New("Peer sent a bitfield of the wrong size.")
+	ErrBadIndex       = errors.New("Peer message refers to an invalid piece.")
+	ErrBlockTooLong   = errors.New("Peer requested a block that is too long.")
+)
+
+// Message is a decoded peer message. Only the fields used by its Type are
+// meaningful. Messages of unknown types, including Extended ones, carry
+// their raw payload.
+type Message struct {
+	KeepAlive bool
+	Type      MessageType
+	Index     uint32 // Have, Request, Piece, Cancel, Suggest, RejectRequest, AllowedFast.
+	Begin     uint32 // Request, Piece, Cancel, RejectRequest.
+	Length    uint32 // Request, Cancel, RejectRequest.
+	Bitfield  []byte // Bitfield.
+	Block     []byte // Piece.
+	Port      uint16 // Port.
+	Payload   []byte // Extended and unknown messages.
+}
+
+func (m *Message) String() string {
+	if m.KeepAlive {
+		return "keep-alive"
+	}
+	switch m.Type {
+	case Have, Suggest, AllowedFast:
+		return fmt.Sprintf("%v %d", m.Type, m.Index)
+	case Request, Cancel, RejectRequest:
+		return fmt.Sprintf("%v %d+%d,%d", m.Type, m.Index, m.Begin, m.Length)
+	case Piece:
+		return fmt.Sprintf("piece %d+%d,%d", m.Index, m.Begin, len(m.Block))
+	case Bitfield:
+		return fmt.Sprintf("bitfield %d bytes", len(m.Bitfield))
+	case Port:
+		return fmt.Sprintf("port %d", m.Port)
+	}
+	return m.Type.String()
+}
+
+// MarshalBinary returns the message framed with its length prefix.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if m.KeepAlive {
+		return make([]byte, 4), nil
+	}
+	var payload []byte
+	switch m.Type {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+	case Have, Suggest, AllowedFast:
+		payload = u32(nil, m.Index)
+	case Request, Cancel, RejectRequest:
+		payload = u32(u32(u32(make([]byte, 0, 12), m.Index), m.Begin), m.Length)
+	case Piece:
+		payload = append(u32(u32(make([]byte, 0, 8+len(m.Block)), m.Index), m.Begin), m.Block...)
+	case Bitfield:
+		payload = m.Bitfield
+	case Port:
+		payload = []byte{byte(m.Port >> 8), byte(m.Port)}
+	default:
+		payload = m.Payload
+	}
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+	buf[4] = byte(m.Type)
+	return append(buf, payload...), nil
+}
+
+func u32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// decode fills m from the message body following the length prefix.
+func (m *Message) decode(body []byte) error {
+	m.Type = MessageType(body[0])
+	p := body[1:]
+	want := -1
+	switch m.Type {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+		want = 0
+	case Have, Suggest, AllowedFast:
+		want = 4
+	case Request, Cancel, RejectRequest:
+		want = 12
+	case Port:
+		want = 2
+	case Piece:
+		if len(p) < 8 {
+			return ErrBadLength
+		}
+	}
+	if want >= 0 && len(p) != want {
+		return ErrBadLength
+	}
+	switch m.Type {
+	case Have, Suggest, AllowedFast:
+		m.Index = binary.BigEndian.Uint32(p)
+	case Request, Cancel, RejectRequest:
+		m.Index = binary.BigEndian.Uint32(p)
+		m.Begin = binary.BigEndian.Uint32(p[4:])
+		m.Length = binary.BigEndian.Uint32(p[8:])
+		if m.Length > MaxBlockLength {
+			return ErrBlockTooLong
+		}
+	case Piece:
+		m.Index = binary.BigEndian.Uint32(p)
+		m.Begin = binary.BigEndian.Uint32(p[4:])
+		m.Block = p[8:]
+	case Bitfield:
+		m.Bitfield = p
+	case Port:
+		m.Port = binary.BigEndian.Uint16(p)
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+	default:
+		m.Payload = p
+	}
+	return nil
+}
+
+// Reader decodes messages from a stream, enforcing length limits so that a
+// hostile peer cannot make us allocate unbounded memory.
+type Reader struct {
+	r io.Reader
+	// MaxLength bounds the length of a message. Zero means
+	// DefaultMaxLength; bitfields are allowed to exceed it when NumPieces
+	// asks for it.
+	MaxLength uint32
+	// NumPieces, when positive, is the number of pieces of the torrent.
+	// Bitfields must then have the matching size with the spare bits
+	// clear, and piece indices must be in range.
+	NumPieces int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (r *Reader) maxLength() uint32 {
+	max := r.MaxLength
+	if max == 0 {
+		max = DefaultMaxLength
+	}
+	if r.NumPieces > 0 {
+		if bf := uint32(1 + (r.NumPieces+7)/8); bf > max {
+			max = bf
+		}
+	}
+	return max
+}
+
+// ReadMessage reads the next message. The returned message owns its
+// buffers.
+func (r *Reader) ReadMessage() (m *Message, err error) {
+	var prefix [4]byte
+	if _, err = io.ReadFull(r.r, prefix[:]); err != nil {
+		return
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return &Message{KeepAlive: true}, nil
+	}
+	if length > r.maxLength() {
+		return nil, ErrMessageTooLong
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	m = new(Message)
+	if err = m.decode(body); err != nil {
+		return nil, err
+	}
+	if err = r.check(m); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (r *Reader) check(m *Message) error {
+	if r.NumPieces <= 0 {
+		return nil
+	}
+	switch m.Type {
+	case Have, Request, Piece, Cancel, Suggest, RejectRequest, AllowedFast:
+		if m.Index >= uint32(r.NumPieces) {
+			return ErrBadIndex
+		}
+	case Bitfield:
+		if len(m.Bitfield) != (r.NumPieces+7)/8 {
+			return ErrBadBitfield
+		}
+		if spare := r.NumPieces & 7; spare != 0 && m.Bitfield[len(m.Bitfield)-1]&(0xff>>byte(spare)) != 0 {
+			return ErrBadBitfield
+		}
+	}
+	return nil
+}
+
+// Writer encodes messages to a stream.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// WriteMessage writes m with a single call to the underlying writer.
+func (w *Writer) WriteMessage(m *Message) error {
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(buf)
+	return err
+}
@@ -0,0 +1,158 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var messages = []Message{
+	{KeepAlive: true},
+	{Type: Choke},
+	{Type: Unchoke},
+	{Type: Interested},
+	{Type: NotInterested},
+	{Type: Have, Index: 7},
+	{Type: Bitfield, Bitfield: []byte{0xff, 0x80}},
+	{Type: Request, Index: 1, Begin: 16384, Length: 16384},
+	{Type: Piece, Index: 1, Begin: 16384, Block: []byte("block data")},
+	{Type: Cancel, Index: 1, Begin: 16384, Length: 16384},
+	{Type: Port, Port: 6881},
+	{Type: Suggest, Index: 3},
+	{Type: HaveAll},
+	{Type: HaveNone},
+	{Type: RejectRequest, Index: 1, Begin: 16384, Length: 16384},
+	{Type: AllowedFast, Index: 8},
+	{Type: Extended, Payload: []byte("\x00d1:md11:ut_metadatai1eee")},
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := range messages {
+		if err := w.WriteMessage(&messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReader(&buf)
+	r.NumPieces = 9
+	for i := range messages {
+		m, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("%v: %v", &messages[i], err)
+		}
+		if !reflect.DeepEqual(*m, messages[i]) {
+			t.Errorf("Got %+v, wanted %+v", *m, messages[i])
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("Wanted EOF, got %v", err)
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	tests := []struct {
+		data      string
+		numPieces int
+		err       error
+	}{
+		{"\xff\xff\xff\xff\x07", 0, ErrMessageTooLong},
+		{"\x00\x02\x00\x0a\x07", 0, ErrMessageTooLong},
+		{"\x00\x00\x00\x02\x00\x00", 0, ErrBadLength},
+		{"\x00\x00\x00\x04\x04\x00\x00\x01", 0, ErrBadLength},
+		{"\x00\x00\x00\x05\x04\x00\x00\x00\x09", 9, ErrBadIndex},
+		{"\x00\x00\x00\x0d\x06\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x01", 0, ErrBlockTooLong},
+		{"\x00\x00\x00\x08\x07\x00\x00\x00\x00\x00\x00\x00", 0, ErrBadLength},
+		{"\x00\x00\x00\x02\x05\xff", 9, ErrBadBitfield},
+		{"\x00\x00\x00\x03\x05\xff\xc0", 9, ErrBadBitfield},
+		{"\x00\x00\x00\x05\x07\x00", 0, io.ErrUnexpectedEOF},
+		{"\x00\x00\x00\x02\x0e\x00", 0, ErrBadLength},
+		{"\x00\x00\x00\x05\x11\x00\x00\x00\x09", 9, ErrBadIndex},
+		{"\x00\x00\x00\x0d\x10\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x01", 0, ErrBlockTooLong},
+	}
+	for _, test := range tests {
+		r := NewReader(bytes.NewReader([]byte(test.data)))
+		r.NumPieces = test.numPieces
+		if _, err := r.ReadMessage(); err != test.err {
+			t.Errorf("%q: got %v, wanted %v", test.data, err, test.err)
+		}
+	}
+	// Bitfields of large torrents may exceed the default limit.
+	r := NewReader(bytes.NewReader(append([]byte("\x00\x04\x00\x01\x05"), make([]byte, 1<<18)...)))
+	r.NumPieces = 1 << 21
+	if m, err := r.ReadMessage(); err != nil || len(m.Bitfield) != 1<<18 {
+		t.Errorf("Large bitfield: %v", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	h := Handshake{}
+	copy(h.InfoHash[:], "01234567890123456789")
+	copy(h.PeerID[:], "-TT0100-abcdefghijkl")
+	h.SetExtensions()
+	h.SetDHT()
+	h.SetFast()
+	var buf bytes.Buffer
+	if err := WriteHandshake(&buf, &h); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != HandshakeLength {
+		t.Fatalf("Handshake has %d bytes", buf.Len())
+	}
+	got, err := ReadHandshake(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h || !got.SupportsExtensions() || !got.SupportsDHT() || !got.SupportsFast() {
+		t.Errorf("Got %+v, wanted %+v", got, h)
+	}
+	if _, err = ReadHandshake(bytes.NewReader([]byte("\x13BitTorrent protocoX"))); err != ErrBadProtocol {
+		t.Errorf("Wanted ErrBadProtocol, got %v", err)
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for i := range messages {
+		buf, _ := messages[i].MarshalBinary()
+		f.Add(buf, 9)
+	}
+	f.Add([]byte("\x00\x00\x00\x03\x05\xff\xc0"), 9)
+	f.Fuzz(func(t *testing.T, data []byte, numPieces int) {
+		r := NewReader(bytes.NewReader(data))
+		r.NumPieces = numPieces % (1 << 20)
+		var consumed int
+		for {
+			m, err := r.ReadMessage()
+			if err != nil {
+				return
+			}
+			// Whatever decodes must encode back to the same bytes.
+			buf, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, data[consumed:consumed+len(buf)]) {
+				t.Fatalf("Re-encoded %v as %x, read from %x", m, buf, data[consumed:])
+			}
+			consumed += len(buf)
+		}
+	})
+}
+
+func FuzzReadHandshake(f *testing.F) {
+	h := Handshake{}
+	h.SetExtensions()
+	buf, _ := h.MarshalBinary()
+	f.Add(buf)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := ReadHandshake(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf, _ := h.MarshalBinary()
+		if !bytes.Equal(buf, data[:HandshakeLength]) {
+			t.Fatalf("Re-encoded handshake differs")
+		}
+	})
+}
@@ -0,0 +1,306 @@
+package wire
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Peer exchange (BEP 11). Peers periodically tell each other which peers
+// they connected to and disconnected from since their last message.
+
+const PexName = "ut_pex"
+
+const (
+	// MinPexInterval is the least time between two PEX messages sent to
+	// a peer.
+	MinPexInterval = time.Minute
+	// MaxPexPeers caps the added and the dropped peers of one message.
+	MaxPexPeers = 50
+)
+
+// PexFlags describe an added peer.
+type PexFlags byte
+
+const (
+	PexEncryption PexFlags = 0x01 // Prefers encrypted connections.
+	PexSeed       PexFlags = 0x02 // Is a seed or partial seed.
+	PexUTP        PexFlags = 0x04 // Supports uTP.
+	PexHolepunch  PexFlags = 0x08 // Supports ut_holepunch.
+	PexReachable  PexFlags = 0x10 // Accepted an outgoing connection.
+)
+
+// PexPeer is a peer address in a PEX message. Flags are only carried for
+// added peers.
+type PexPeer struct {
+	IP    net.IP
+	Port  uint16
+	Flags PexFlags
+}
+
+func (p PexPeer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+func (p PexPeer) key() string {
+	return string(append(p.IP.To16(), byte(p.Port>>8), byte(p.Port)))
+}
+
+// PexMessage is the payload of a ut_pex message.
+type PexMessage struct {
+	Added   []PexPeer
+	Dropped []PexPeer
+}
+
+func (m *PexMessage) MarshalBinary() ([]byte, error) {
+	var added, addedF, added6, added6F, dropped, dropped6 []byte
+	for _, p := range m.Added {
+		if ip := p.IP.To4(); ip != nil {
+			added = appendPexPeer(added, ip, p.Port)
+			addedF = append(addedF, byte(p.Flags))
+		} else if len(p.IP) == net.IPv6len {
+			added6 = appendPexPeer(added6, p.IP, p.Port)
+			added6F = append(added6F, byte(p.Flags))
+		}
+	}
+	for _, p := range m.Dropped {
+		if ip := p.IP.To4(); ip != nil {
+			dropped = appendPexPeer(dropped, ip, p.Port)
+		} else if len(p.IP) == net.IPv6len {
+			dropped6 = appendPexPeer(dropped6, p.IP, p.Port)
+		}
+	}
+	d := map[string]interface{}{
+		"added":   string(added),
+		"added.f": string(addedF),
+		"dropped": string(dropped),
+	}
+	if len(added6) > 0 || len(dropped6) > 0 {
+		d["added6"] = string(added6)
+		d["added6.f"] = string(added6F)
+		d["dropped6"] = string(dropped6)
+	}
+	return EncodeDict(d, nil)
+}
+
+func appendPexPeer(b []byte, ip net.IP, port uint16) []byte {
+	return append(append(b, ip...), byte(port>>8), byte(port))
+}
+
+// UnmarshalBinary decodes a ut_pex payload. Malformed trailing entries
+// and missing flags are tolerated, as peers in the wild send them.
+func (m *PexMessage) UnmarshalBinary(b []byte) error {
+	d, _, err := DecodeDict(b)
+	if err != nil {
+		return err
+	}
+	get := func(k string) []byte {
+		s, _ := d[k].(string)
+		return []byte(s)
+	}
+	*m = PexMessage{
+		Added:   parsePexPeers(get("added"), get("added.f"), net.IPv4len),
+		Dropped: parsePexPeers(get("dropped"), nil, net.IPv4len),
+	}
+	m.Added = append(m.Added, parsePexPeers(get("added6"), get("added6.f"), net.IPv6len)...)
+	m.Dropped = append(m.Dropped, parsePexPeers(get("dropped6"), nil, net.IPv6len)...)
+	return nil
+}
+
+func parsePexPeers(b, flags []byte, n int) (peers []PexPeer) {
+	for i := 0; len(b) >= n+2; i++ {
+		p := PexPeer{IP: net.IP(append([]byte(nil), b[:n]...)), Port: binary.BigEndian.Uint16(b[n:])}
+		if i < len(flags) {
+			p.Flags = PexFlags(flags[i])
+		}
+		peers = append(peers, p)
+		b = b[n+2:]
+	}
+	return
+}
+
+// PexPool is a set of peers learnt through PEX, deduplicated across
+// connections. It is safe for concurrent use.
+type PexPool struct {
+	mu    sync.Mutex
+	peers map[string]PexPeer
+}
+
+func NewPexPool() *PexPool {
+	return &PexPool{peers: make(map[string]PexPeer)}
+}
+
+// Add adds peers to the pool and returns those that were not in it yet.
+func (pp *PexPool) Add(peers ...PexPeer) (fresh []PexPeer) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, p := range peers {
+		k := p.key()
+		if _, ok := pp.peers[k]; !ok {
+			pp.peers[k] = p
+			fresh = append(fresh, p)
+		}
+	}
+	return
+}
+
+func (pp *PexPool) Len() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return len(pp.peers)
+}
+
+// Peers returns the peers in the pool.
+func (pp *PexPool) Peers() (r []PexPeer) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, p := range pp.peers {
+		r = append(r, p)
+	}
+	return
+}
+
+// Pex is the ut_pex extension. Register it with a Registry shared by the
+// connections of one torrent; it keeps what was exchanged with each of
+// them. PEX must not be used for private torrents.
+type Pex struct {
+	// Pool, if not nil, deduplicates received peers.
+	Pool *PexPool
+	// OnPeers is called with the peers a connection reports. Added peers
+	// already in Pool are left out.
+	OnPeers func(p *ExtendedPeer, added, dropped []PexPeer)
+
+	mu    sync.Mutex
+	peers map[*ExtendedPeer]*pexState
+	now   func() time.Time
+}
+
+type pexState struct {
+	sent     map[string]PexPeer // What the peer was told is connected.
+	lastSent time.Time
+	lastRecv time.Time
+}
+
+func NewPex(pool *PexPool) *Pex {
+	return &Pex{Pool: pool, peers: make(map[*ExtendedPeer]*pexState)}
+}
+
+func (x *Pex) clock() time.Time {
+	if x.now != nil {
+		return x.now()
+	}
+	return time.Now()
+}
+
+func (x *Pex) state(p *ExtendedPeer) *pexState {
+	st, ok := x.peers[p]
+	if !ok {
+		st = &pexState{sent: make(map[string]PexPeer)}
+		x.peers[p] = st
+	}
+	return st
+}
+
+// Forget drops the state kept for a closed connection.
+func (x *Pex) Forget(p *ExtendedPeer) {
+	x.mu.Lock()
+	delete(x.peers, p)
+	x.mu.Unlock()
+}
+
+// HandleExtended processes a PEX message. Messages arriving more than
+// twice as often as allowed are ignored.
+func (x *Pex) HandleExtended(p *ExtendedPeer, payload []byte) error {
+	var m PexMessage
+	if err := m.UnmarshalBinary(payload); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	st := x.state(p)
+	now := x.clock()
+	if !st.lastRecv.IsZero() && now.Sub(st.lastRecv) < MinPexInterval/2 {
+		x.mu.Unlock()
+		return nil
+	}
+	st.lastRecv = now
+	x.mu.Unlock()
+	if len(m.Added) > MaxPexPeers {
+		m.Added = m.Added[:MaxPexPeers]
+	}
+	if len(m.Dropped) > MaxPexPeers {
+		m.Dropped = m.Dropped[:MaxPexPeers]
+	}
+	added := m.Added
+	if x.Pool != nil {
+		added = x.Pool.Add(added...)
+	}
+	if x.OnPeers != nil && (len(added) > 0 || len(m.Dropped) > 0) {
+		x.OnPeers(p, added, m.Dropped)
+	}
+	return nil
+}
+
+// Update tells p about changes in our connected peers, which should not
+// include p itself. Nothing is sent if the last message to p was less than
+// MinPexInterval ago or nothing changed. At most MaxPexPeers added and
+// dropped peers are sent; the rest follow in later messages.
+func (x *Pex) Update(p *ExtendedPeer, connected []PexPeer) error {
+	if !p.Supports(PexName) {
+		return ErrNotNegotiated
+	}
+	x.mu.Lock()
+	st := x.state(p)
+	now := x.clock()
+	if !st.lastSent.IsZero() && now.Sub(st.lastSent) < MinPexInterval {
+		x.mu.Unlock()
+		return nil
+	}
+	var m PexMessage
+	current := make(map[string]bool, len(connected))
+	for _, c := range connected {
+		k := c.key()
+		current[k] = true
+		if _, ok := st.sent[k]; !ok && len(m.Added) < MaxPexPeers {
+			m.Added = append(m.Added, c)
+		}
+	}
+	for k, s := range st.sent {
+		if !current[k] && len(m.Dropped) < MaxPexPeers {
+			m.Dropped = append(m.Dropped, s)
+		}
+	}
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		x.mu.Unlock()
+		return nil
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		x.mu.Unlock()
+		return err
+	}
+	// The state is committed before sending so that concurrent updates
+	// wait for the interval, and rolled back if the send fails.
+	for _, a := range m.Added {
+		st.sent[a.key()] = a
+	}
+	for _, d := range m.Dropped {
+		delete(st.sent, d.key())
+	}
+	last := st.lastSent
+	st.lastSent = now
+	x.mu.Unlock()
+	if err = p.Send(PexName, b); err != nil {
+		x.mu.Lock()
+		for _, a := range m.Added {
+			delete(st.sent, a.key())
+		}
+		for _, d := range m.Dropped {
+			st.sent[d.key()] = d
+		}
+		st.lastSent = last
+		x.mu.Unlock()
+	}
+	return err
+}
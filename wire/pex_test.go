@@ -0,0 +1,190 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPexMessage(t *testing.T) {
+	m := &PexMessage{
+		Added: []PexPeer{
+			{IP: net.IP{10, 0, 0, 1}, Port: 6881, Flags: PexSeed | PexReachable},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6882, Flags: PexUTP},
+		},
+		Dropped: []PexPeer{{IP: net.IP{10, 0, 0, 2}, Port: 80}},
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "d5:added6:\x0a\x00\x00\x01\x1a\xe17:added.f1:\x126:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2" +
+		"8:added6.f1:\x047:dropped6:\x0a\x00\x00\x02\x00\x508:dropped60:e"
+	if string(b) != want {
+		t.Errorf("Got %q\nwanted %q", b, want)
+	}
+	var back PexMessage
+	if err = back.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&back, m) {
+		t.Errorf("Got %+v, wanted %+v", back, m)
+	}
+	// Missing flags and partial entries are tolerated.
+	if err = back.UnmarshalBinary([]byte("d5:added8:\x0a\x00\x00\x01\x1a\xe1\x01\x02e")); err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Added) != 1 || back.Added[0].Flags != 0 || back.Added[0].String() != "10.0.0.1:6881" {
+		t.Errorf("Got %+v", back)
+	}
+}
+
+func TestPexExchange(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	pool := NewPexPool()
+	var got [][]PexPeer
+	var gotDropped []PexPeer
+	rx := NewPex(pool)
+	rx.now = clock
+	rx.OnPeers = func(p *ExtendedPeer, added, dropped []PexPeer) {
+		got = append(got, added)
+		gotDropped = append(gotDropped, dropped...)
+	}
+	tx := NewPex(nil)
+	tx.now = clock
+	regRx, regTx := NewRegistry(), NewRegistry()
+	regRx.Register(PexName, rx)
+	regTx.Register(PexName, tx)
+
+	// Two sending connections feed the same receiving pool.
+	var wires [2]bytes.Buffer
+	var senders, receivers [2]*ExtendedPeer
+	var handshakes bytes.Buffer
+	for i := range senders {
+		senders[i] = regTx.NewPeer(NewWriter(&wires[i]))
+		receivers[i] = regRx.NewPeer(NewWriter(&handshakes))
+		if err := tx.Update(senders[i], nil); err != ErrNotNegotiated {
+			t.Errorf("Update before handshake got %v", err)
+		}
+		receivers[i].SendHandshake(regRx.Handshake())
+		m, err := NewReader(&handshakes).ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = senders[i].Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliver := func(i int) {
+		r := NewReader(&wires[i])
+		for wires[i].Len() > 0 {
+			m, err := r.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = receivers[i].Handle(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a := PexPeer{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	b := PexPeer{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	c := PexPeer{IP: net.ParseIP("2001:db8::3"), Port: 3}
+	if err := tx.Update(senders[0], []PexPeer{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Update(senders[1], []PexPeer{b, c}); err != nil {
+		t.Fatal(err)
+	}
+	deliver(0)
+	deliver(1)
+	if len(got) != 2 || len(got[0]) != 2 || len(got[1]) != 1 || !got[1][0].IP.Equal(c.IP) || pool.Len() != 3 {
+		t.Fatalf("Got %v, pool has %d", got, pool.Len())
+	}
+
+	// Updates wait for the interval and carry only changes.
+	tx.Update(senders[0], []PexPeer{b, c})
+	if wires[0].Len() != 0 {
+		t.Error("Update sent within the interval")
+	}
+	now = now.Add(MinPexInterval)
+	tx.Update(senders[0], []PexPeer{b, c})
+	deliver(0)
+	if len(gotDropped) != 1 || gotDropped[0].String() != a.String() {
+		t.Errorf("Got dropped %v", gotDropped)
+	}
+	now = now.Add(MinPexInterval)
+	tx.Update(senders[0], []PexPeer{b, c})
+	if wires[0].Len() != 0 {
+		t.Error("Update sent without changes")
+	}
+
+	// A peer flooding us with PEX is ignored.
+	calls := len(got)
+	for i := 0; i < 3; i++ {
+		flood := &PexMessage{Added: []PexPeer{{IP: net.IP{10, 0, 1, byte(i)}, Port: 9}}}
+		payload, _ := flood.MarshalBinary()
+		rx.HandleExtended(receivers[0], payload)
+		if i == 1 {
+			rx.Forget(receivers[0])
+		}
+	}
+	if len(got) != calls+2 {
+		t.Errorf("Processed %d of 3 messages, wanted the first and the one after Forget", len(got)-calls)
+	}
+}
+
+type failWriter struct {
+	fail bool
+	bytes.Buffer
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("Write failed.")
+	}
+	return w.Buffer.Write(b)
+}
+
+func TestPexSendFailure(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tx := NewPex(nil)
+	tx.now = func() time.Time { return now }
+	regRx, regTx := NewRegistry(), NewRegistry()
+	regRx.Register(PexName, NewPex(nil))
+	regTx.Register(PexName, tx)
+	w := &failWriter{fail: true}
+	sender := regTx.NewPeer(NewWriter(w))
+	var handshakes bytes.Buffer
+	regRx.NewPeer(NewWriter(&handshakes)).SendHandshake(regRx.Handshake())
+	m, err := NewReader(&handshakes).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sender.Handle(m); err != nil {
+		t.Fatal(err)
+	}
+	a := PexPeer{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	if err = tx.Update(sender, []PexPeer{a}); err == nil {
+		t.Fatal("Update succeeded on a failing connection")
+	}
+	// Nothing counts as sent, so the retry carries a without waiting.
+	w.fail = false
+	if err = tx.Update(sender, []PexPeer{a}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = NewReader(&w.Buffer).ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	var pm PexMessage
+	if err = pm.UnmarshalBinary(m.Payload[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(pm.Added) != 1 || pm.Added[0].String() != a.String() {
+		t.Errorf("Retry sent %+v", pm)
+	}
+}